@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"github.com/godofcc/go-common/lib/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAdminListLimit = 100
+	maxAdminListLimit     = 10000
+	adminHotKeys          = 10
+)
+
+// Authorizer decides whether a request to the admin handler may modify the cache.
+type Authorizer interface {
+	Authorize(r *http.Request) bool
+}
+
+// AuthorizerFunc adapts a function to Authorizer.
+type AuthorizerFunc func(r *http.Request) bool
+
+func (f AuthorizerFunc) Authorize(r *http.Request) bool {
+	return f(r)
+}
+
+// AdminStats is the statistics document served by the admin handler.
+type AdminStats struct {
+	HitRate           float64
+	HitCount          int64
+	MissCount         int64
+	EvacuateCount     int64
+	ExpiredCount      int64
+	EntryCount        int64
+	AverageAccessTime int64
+	OverwriteCount    int64
+	TouchedCount      int64
+	PinnedCount       int64
+	PinnedBytes       int64
+	HotKeys           []HotKey `json:",omitempty"`
+	HotKeysByBytes    []HotKey `json:",omitempty"`
+}
+
+// AdminEntry describes an entry in the responses of the admin handler.
+// TTL is the time left in milliseconds, 0 if the entry never expires.
+type AdminEntry struct {
+	Key   string
+	Value []byte `json:",omitempty"`
+	Size  int
+	TTL   int64
+}
+
+type adminHandler struct {
+	cache *Cache
+	auth  Authorizer
+	mux   *http.ServeMux
+}
+
+// NewAdminHandler returns a handler to inspect the cache, meant to be mounted with http.StripPrefix:
+//
+//	GET    /stats                       statistics as AdminStats
+//	GET    /key?key=k                   the entry of key k as AdminEntry
+//	DELETE /key?key=k                   deletes key k
+//	GET    /keys?prefix=p&limit=n       up to n (100 by default) entries whose key starts with p, without values
+//	POST   /clear                       clears the cache
+//	POST   /reset-stats                 resets the statistics
+//
+// Lookups do not count as hits or misses. Requests that modify the cache are answered
+// with 403 unless auth authorizes them, a nil auth rejects all of them.
+func NewAdminHandler(cache *Cache, auth Authorizer) http.Handler {
+	h := &adminHandler{cache: cache, auth: auth, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/stats", h.stats)
+	h.mux.HandleFunc("/key", h.key)
+	h.mux.HandleFunc("/keys", h.keys)
+	h.mux.HandleFunc("/clear", h.mutation(func() interface{} {
+		h.cache.Clear()
+		return struct{}{}
+	}))
+	h.mux.HandleFunc("/reset-stats", h.mutation(func() interface{} {
+		h.cache.ResetStatistics()
+		return struct{}{}
+	}))
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *adminHandler) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if h.auth == nil || !h.auth.Authorize(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *adminHandler) mutation(fn func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.authorized(w, r) {
+			writeJSON(w, http.StatusOK, fn())
+		}
+	}
+}
+
+func (h *adminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hotKeys, hotKeysByBytes := h.cache.HotKeys(adminHotKeys)
+	writeJSON(w, http.StatusOK, AdminStats{
+		HitRate:           h.cache.HitRate(),
+		HitCount:          h.cache.HitCount(),
+		MissCount:         h.cache.MissCount(),
+		EvacuateCount:     h.cache.EvacuateCount(),
+		ExpiredCount:      h.cache.ExpiredCount(),
+		EntryCount:        h.cache.EntryCount(),
+		AverageAccessTime: h.cache.AverageAccessTime(),
+		OverwriteCount:    h.cache.OverwriteCount(),
+		TouchedCount:      h.cache.TouchedCount(),
+		PinnedCount:       h.cache.PinnedCount(),
+		PinnedBytes:       h.cache.PinnedBytes(),
+		HotKeys:           hotKeys,
+		HotKeysByBytes:    hotKeysByBytes,
+	})
+}
+
+func (h *adminHandler) key(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		entry := AdminEntry{Key: key}
+		err := h.cache.PeekFn([]byte(key), func(value []byte) error {
+			entry.Value = append([]byte(nil), value...)
+			return nil
+		})
+		var ttl time.Duration
+		if err == nil {
+			ttl, err = h.cache.TTLDuration([]byte(key))
+		}
+		if err == ErrNotFound {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entry.Size = len(entry.Value)
+		entry.TTL = int64(ttl / time.Millisecond)
+		writeJSON(w, http.StatusOK, entry)
+	case http.MethodDelete:
+		if h.authorized(w, r) {
+			writeJSON(w, http.StatusOK, struct{ Deleted bool }{h.cache.Del([]byte(key))})
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *adminHandler) keys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultAdminListLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxAdminListLimit {
+		limit = maxAdminListLimit
+	}
+	nowMs := nowMilli(h.cache.timer)
+	entries := []AdminEntry{}
+	h.cache.ScanPrefix([]byte(query.Get("prefix")), func(e *Entry) bool {
+		entry := AdminEntry{Key: string(e.Key), Size: len(e.Value)}
+		if e.ExpireAt != 0 {
+			entry.TTL = e.ExpireAt - nowMs
+		}
+		entries = append(entries, entry)
+		return len(entries) < limit
+	})
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrNotAdmitted is returned by the setters when the admission policy refused to store a new
+// entry, the write is dropped and counted by RejectedCount.
+var ErrNotAdmitted = errors.New("The entry was not admitted by the admission policy")
+
+// AdmissionPolicy decides whether a new entry may evict an existing one when a segment is full.
+type AdmissionPolicy int
+
+const (
+	// AdmissionAlways admits every new entry, the segment evicts by approximate LRU.
+	AdmissionAlways AdmissionPolicy = iota
+	// AdmissionTinyLFU admits a new entry only if its key was accessed more often than
+	// the key of the entry it would evict, so a scan of cold keys can not flush hot ones.
+	// Access frequencies are estimated by a count-min sketch behind a doorkeeper bloom filter,
+	// which take 2.5 bytes per 64 bytes of segment size, rounded up to a power of two.
+	AdmissionTinyLFU
+)
+
+const (
+	sketchDepth = 4
+	// sketchBytesPerEntry is the expected average entry size used to size the sketch.
+	sketchBytesPerEntry = 64
+	// sketchResetFactor halves the counters after sketchResetFactor*width recorded accesses.
+	sketchResetFactor = 10
+)
+
+// tinyLFU estimates the access frequency of the keys of a segment.
+// Keys are identified by bits 8 to 31 of their hash, which entryHdr keeps as slotId and hash16.
+type tinyLFU struct {
+	counters  []uint64 // sketchDepth rows of width 4-bit counters.
+	door      []uint64 // doorkeeper bloom filter bits.
+	mask      uint32
+	additions int
+}
+
+func newTinyLFU(bufSize int) *tinyLFU {
+	width := 64
+	for width < bufSize/sketchBytesPerEntry {
+		width <<= 1
+	}
+	return &tinyLFU{
+		counters: make([]uint64, sketchDepth*width/16),
+		door:     make([]uint64, width/16),
+		mask:     uint32(width - 1),
+	}
+}
+
+func lfuKey(slotId uint8, hash16 uint16) uint32 {
+	return uint32(slotId) | uint32(hash16)<<8
+}
+
+func (f *tinyLFU) indexes(key uint32) (idx [sketchDepth]uint32) {
+	x := uint64(key)*0x9e3779b97f4a7c15 + 1
+	for i := range idx {
+		x ^= x >> 29
+		x *= 0xbf58476d1ce4e5b9
+		idx[i] = uint32(x>>32) & f.mask
+	}
+	return
+}
+
+func (f *tinyLFU) counter(row int, idx uint32) uint64 {
+	pos := uint32(row)*(f.mask+1) + idx
+	return f.counters[pos/16] >> (pos % 16 * 4) & 0xf
+}
+
+// doorBits returns the two doorkeeper bits of a key, derived from its sketch indexes.
+func (f *tinyLFU) doorBits(idx [sketchDepth]uint32) (bit0, bit1 uint32) {
+	return idx[0]*4 + idx[2]&3, idx[1]*4 + idx[3]&3
+}
+
+func (f *tinyLFU) inDoor(bit uint32) bool {
+	return f.door[bit/64]&(1<<(bit%64)) != 0
+}
+
+// record counts an access to the key.
+func (f *tinyLFU) record(key uint32) {
+	idx := f.indexes(key)
+	bit0, bit1 := f.doorBits(idx)
+	if !f.inDoor(bit0) || !f.inDoor(bit1) {
+		f.door[bit0/64] |= 1 << (bit0 % 64)
+		f.door[bit1/64] |= 1 << (bit1 % 64)
+	} else {
+		for row, i := range idx {
+			if f.counter(row, i) < 15 {
+				pos := uint32(row)*(f.mask+1) + i
+				f.counters[pos/16] += 1 << (pos % 16 * 4)
+			}
+		}
+	}
+	f.additions++
+	if f.additions >= sketchResetFactor*int(f.mask+1) {
+		f.reset()
+	}
+}
+
+// estimate returns the approximate number of recent accesses to the key.
+func (f *tinyLFU) estimate(key uint32) int {
+	idx := f.indexes(key)
+	min := uint64(15)
+	for row, i := range idx {
+		if c := f.counter(row, i); c < min {
+			min = c
+		}
+	}
+	bit0, bit1 := f.doorBits(idx)
+	if f.inDoor(bit0) && f.inDoor(bit1) {
+		min++
+	}
+	return int(min)
+}
+
+// reset halves all counters and clears the doorkeeper so old accesses age out.
+func (f *tinyLFU) reset() {
+	for i := range f.counters {
+		f.counters[i] = f.counters[i] >> 1 & 0x7777777777777777
+	}
+	for i := range f.door {
+		f.door[i] = 0
+	}
+	f.additions = 0
+}
+
+// admit reports whether a new entry for the key may be written into the segment.
+// It is only consulted when writing the entry needs to evict others.
+func (seg *segment) admit(slotId uint8, hash16 uint16, entryLen int64, nowMs int64) bool {
+	if seg.admission == nil || seg.vacuumLen >= entryLen {
+		return true
+	}
+	victim, ok := seg.victim(nowMs)
+	if !ok {
+		return true
+	}
+	if seg.admission.estimate(lfuKey(slotId, hash16)) > seg.admission.estimate(victim) {
+		return true
+	}
+	atomic.AddInt64(&seg.totalRejected, 1)
+	return false
+}
+
+// victim returns the key of the first entry evacuate would evict, skipping pinned entries
+// as evacuate does. It returns false if that entry is already expired, expired entries
+// never block admission.
+func (seg *segment) victim(nowMs int64) (key uint32, ok bool) {
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	off := seg.rb.End() + seg.vacuumLen - seg.rb.Size()
+	spared := 0
+	for off < seg.rb.End() {
+		seg.rb.ReadAt(hdrBuf[:], off)
+		off += ENTRY_HDR_SIZE + int64(hdr.keyLen) + int64(hdr.valCap)
+		if hdr.has(flagDeleted) {
+			continue
+		}
+		if hdr.expireAt != 0 && hdr.expireAt < nowMs {
+			return 0, false
+		}
+		if hdr.has(flagPinned) {
+			continue
+		}
+		leastRecentUsed := int64(hdr.accessTime)*atomic.LoadInt64(&seg.totalCount) <= atomic.LoadInt64(&seg.totalTime)
+		if leastRecentUsed || spared > 5 {
+			return lfuKey(hdr.slotId, hdr.hash16), true
+		}
+		spared++
+	}
+	return 0, false
+}
+
+// RejectedCount returns the number of new entries the admission policy refused to store.
+func (cache *Cache) RejectedCount() (count int64) {
+	for i := range cache.segments {
+		count += atomic.LoadInt64(&cache.segments[i].totalRejected)
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"errors"
+)
+
+var ErrBatchLength = errors.New("The numbers of keys and values differ")
+
+// batch hashes all keys up front and calls fn for every key grouped by segment,
+// so that each segment lock is taken at most once for the whole batch.
+func (cache *Cache) batch(keys [][]byte, fn func(seg *segment, i int, hashVal uint64)) {
+	hashes := make([]uint64, len(keys))
+	starts := make([]int, len(cache.segments)+1)
+	for i, key := range keys {
+		hashes[i] = cache.hasher.Sum64(key)
+		starts[cache.segmentID(hashes[i])+1]++
+	}
+	for segID := 1; segID < len(starts); segID++ {
+		starts[segID] += starts[segID-1]
+	}
+	order := make([]int, len(keys))
+	next := append([]int(nil), starts...)
+	for i, hashVal := range hashes {
+		segID := cache.segmentID(hashVal)
+		order[next[segID]] = i
+		next[segID]++
+	}
+	for segID := range cache.segments {
+		group := order[starts[segID]:starts[segID+1]]
+		if len(group) == 0 {
+			continue
+		}
+		cache.locks[segID].Lock()
+		for _, i := range group {
+			fn(&cache.segments[segID], i, hashes[i])
+		}
+		cache.unlockSegment(uint64(segID))
+	}
+}
+
+// MultiGet looks up several keys at once.
+// values[i] and found[i] hold the result for keys[i].
+func (cache *Cache) MultiGet(keys [][]byte) (values [][]byte, found []bool) {
+	values = make([][]byte, len(keys))
+	found = make([]bool, len(keys))
+	cache.batch(keys, func(seg *segment, i int, hashVal uint64) {
+		value, _, err := seg.get(keys[i], nil, hashVal, false)
+		if err == nil {
+			values[i] = value
+			found[i] = true
+		}
+	})
+	return
+}
+
+// MultiSet sets several entries at once with the same expiration.
+// errs[i] holds the error of setting keys[i] to values[i]. If keys and values
+// differ in length nothing is set and every key gets ErrBatchLength.
+func (cache *Cache) MultiSet(keys, values [][]byte, expireSeconds int) (errs []error) {
+	errs = make([]error, len(keys))
+	if len(keys) != len(values) {
+		for i := range errs {
+			errs[i] = ErrBatchLength
+		}
+		return
+	}
+	stored := make([]storedValue, len(keys))
+	for i := range keys {
+		stored[i] = cache.encodeValue(keys[i], values[i])
+	}
+	cache.batch(keys, func(seg *segment, i int, hashVal uint64) {
+		errs[i] = seg.set(keys[i], stored[i], hashVal, secondsToTTL(expireSeconds))
+	})
+	return
+}
+
+// MultiDel deletes several keys at once.
+// affected[i] reports whether keys[i] was present.
+func (cache *Cache) MultiDel(keys [][]byte) (affected []bool) {
+	affected = make([]bool, len(keys))
+	cache.batch(keys, func(seg *segment, i int, hashVal uint64) {
+		affected[i] = seg.del(keys[i], hashVal)
+	})
+	return
+}
@@ -1,26 +1,39 @@
+// Package cache is a segmented cache derived from freecache. Entries are stored in ring
+// buffers, so the number of entries does not add to the work of the garbage collector.
+// Every entry takes a 32 byte header besides its key and value: freecache uses 24 bytes,
+// the millisecond expiration times take 8 more bytes per entry.
 package cache
 
 import (
 	"encoding/binary"
-	"github.com/cespare/xxhash"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	segmentCount = 256
-	// segmentAndOpVal is bitwise AND applied to the hashVal to find the segment id.
-	segmentAndOpVal = 255
-	minBufSize      = 512 * 1024
+	minBufSize   = 512 * 1024
 )
 
 type Cache struct {
-	locks    [segmentCount]sync.Mutex
-	segments [segmentCount]segment
-}
-
-func hashFunc(data []byte) uint64 {
-	return xxhash.Sum64(data)
+	locks    []sync.RWMutex
+	segments []segment
+	segMask  uint64
+	hasher   Hasher
+	timer    Timer
+	loads    loadGroup
+	tags     tagRegistry
+	cipher   valueCipher
+	// compression is shared by the segments, nil unless values are compressed.
+	compression *compressor
+	refresh     refresher
+	events      eventHub
+	janitor     *janitor
+	hot         *hotKeys
+	mapped      *mappedFile
+	// readOptimized serves reads under the segment read lock, see Options.ReadOptimized.
+	readOptimized bool
 }
 
 func NewCache(size int) (cache *Cache) {
@@ -28,63 +41,102 @@ func NewCache(size int) (cache *Cache) {
 }
 
 func NewCacheCustomTimer(size int, timer Timer) (cache *Cache) {
-	if size < minBufSize {
-		size = minBufSize
-	}
-	if timer == nil {
-		timer = defaultTimer{}
-	}
-	cache = new(Cache)
-	for i := 0; i < segmentCount; i++ {
-		cache.segments[i] = newSegment(size/segmentCount, i, timer)
-	}
-	return
+	return NewCacheWithOptions(Options{Size: size, Timer: timer})
+}
+
+// segmentID returns the segment of a hash value.
+// The low byte selects the segment as it did with the fixed 256 segments, caches with
+// more segments take the remaining bits from the top of the hash so they do not overlap
+// the slot id and hash16 (bits 8 to 31) used inside the segment.
+func (cache *Cache) segmentID(hashVal uint64) uint64 {
+	return (hashVal&0xff | hashVal>>32<<8) & cache.segMask
+}
+
+// secondsToTTL converts the expireSeconds argument of the second based API.
+func secondsToTTL(expireSeconds int) time.Duration {
+	return time.Duration(expireSeconds) * time.Second
+}
+
+// expireAtSeconds converts an expiration time in milliseconds to Unix seconds, rounding up.
+func expireAtSeconds(expireAtMs int64) uint32 {
+	return uint32((expireAtMs + 999) / 1000)
 }
 
 func (cache *Cache) Set(key, value []byte, expireSeconds int) (err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	return cache.SetWithTTL(key, value, secondsToTTL(expireSeconds))
+}
+
+// SetWithTTL sets the value with a millisecond precision time to live.
+// A ttl <= 0 means the entry never expires.
+func (cache *Cache) SetWithTTL(key, value []byte, ttl time.Duration) (err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	v := cache.encodeValue(key, value)
 	cache.locks[segID].Lock()
-	err = cache.segments[segID].set(key, value, hashVal, expireSeconds)
-	cache.locks[segID].Unlock()
+	err = cache.segments[segID].set(key, v, hashVal, ttl)
+	cache.unlockSegment(segID)
 	return
 }
 
 func (cache *Cache) Touch(key []byte, expireSeconds int) (err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	return cache.TouchWithTTL(key, secondsToTTL(expireSeconds))
+}
+
+// TouchWithTTL updates the time to live of an existing entry.
+func (cache *Cache) TouchWithTTL(key []byte, ttl time.Duration) (err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
 	cache.locks[segID].Lock()
-	err = cache.segments[segID].touch(key, hashVal, expireSeconds)
-	cache.locks[segID].Unlock()
+	err = cache.segments[segID].touch(key, hashVal, ttl)
+	cache.unlockSegment(segID)
 	return
 }
 
 func (cache *Cache) Get(key []byte) (value []byte, err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	if cache.readOptimized {
+		var ok bool
+		if value, _, ok, err = cache.getReadOptimized(key, nil, hashVal); ok {
+			return
+		}
+	}
+	segID := cache.segmentID(hashVal)
 	cache.locks[segID].Lock()
 	value, _, err = cache.segments[segID].get(key, nil, hashVal, false)
-	cache.locks[segID].Unlock()
+	cache.unlockSegment(segID)
 	return
 }
 
 func (cache *Cache) GetFn(key []byte, fn func([]byte) error) (err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	if cache.readOptimized {
+		var ok bool
+		cache.locks[segID].RLock()
+		ok, err = cache.segments[segID].viewShared(key, fn, hashVal)
+		cache.locks[segID].RUnlock()
+		if ok && err != ErrNotFound {
+			cache.recordSharedHit(segID, key)
+		}
+		if ok {
+			return
+		}
+	}
 	cache.locks[segID].Lock()
 	err = cache.segments[segID].view(key, fn, hashVal, false)
-	cache.locks[segID].Unlock()
+	cache.unlockSegment(segID)
 	return err
 }
 
 func (cache *Cache) GetOrSet(key, value []byte, expireSeconds int) (retValue []byte, err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	v := cache.encodeValue(key, value)
 	cache.locks[segID].Lock()
-	defer cache.locks[segID].Unlock()
+	defer cache.unlockSegment(segID)
 	retValue, _, err = cache.segments[segID].get(key, nil, hashVal, false)
 	if err != nil {
-		err = cache.segments[segID].set(key, value, hashVal, expireSeconds)
+		err = cache.segments[segID].set(key, v, hashVal, secondsToTTL(expireSeconds))
 	}
 	return
 
@@ -92,60 +144,94 @@ func (cache *Cache) GetOrSet(key, value []byte, expireSeconds int) (retValue []b
 
 func (cache *Cache) SetAndGet(key, value []byte, expireSeconds int) (retValue []byte, found bool, err error) {
 
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	v := cache.encodeValue(key, value)
 	cache.locks[segID].Lock()
-	defer cache.locks[segID].Unlock()
+	defer cache.unlockSegment(segID)
 	retValue, _, err = cache.segments[segID].get(key, nil, hashVal, false)
 	if err == nil {
 		found = true
 	}
-	err = cache.segments[segID].set(key, value, hashVal, expireSeconds)
+	err = cache.segments[segID].set(key, v, hashVal, secondsToTTL(expireSeconds))
 	return
 }
 
 func (cache *Cache) PeekFn(key []byte, fn func([]byte) error) (err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	if cache.readOptimized {
+		// A peek does not modify the segment.
+		cache.locks[segID].RLock()
+		err = cache.segments[segID].view(key, fn, hashVal, true)
+		cache.locks[segID].RUnlock()
+		return
+	}
 	cache.locks[segID].Lock()
 	err = cache.segments[segID].view(key, fn, hashVal, true)
-	cache.locks[segID].Unlock()
+	cache.unlockSegment(segID)
 	return
 }
 
 func (cache *Cache) GetWithBuf(key, buf []byte) (value []byte, err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	if cache.readOptimized {
+		var ok bool
+		if value, _, ok, err = cache.getReadOptimized(key, buf, hashVal); ok {
+			return
+		}
+	}
+	segID := cache.segmentID(hashVal)
 	cache.locks[segID].Lock()
 	value, _, err = cache.segments[segID].get(key, buf, hashVal, false)
-	cache.locks[segID].Unlock()
+	cache.unlockSegment(segID)
 	return
 }
 
+// GetWithExpiration returns the value with its expiration time in Unix seconds, 0 means no expiration.
 func (cache *Cache) GetWithExpiration(key []byte) (value []byte, expireAt uint32, err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	var expireAtMs int64
+	if cache.readOptimized {
+		var ok bool
+		if value, expireAtMs, ok, err = cache.getReadOptimized(key, nil, hashVal); ok {
+			expireAt = expireAtSeconds(expireAtMs)
+			return
+		}
+	}
+	segID := cache.segmentID(hashVal)
 	cache.locks[segID].Lock()
-	value, expireAt, err = cache.segments[segID].get(key, nil, hashVal, false)
-	cache.locks[segID].Unlock()
+	value, expireAtMs, err = cache.segments[segID].get(key, nil, hashVal, false)
+	cache.unlockSegment(segID)
+	expireAt = expireAtSeconds(expireAtMs)
 	return
 }
 
+// TTL returns the time left in seconds, rounded up. 0 means the entry never expires.
 func (cache *Cache) TTL(key []byte) (timeLeft uint32, err error) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	ttl, err := cache.TTLDuration(key)
+	if ttl > 0 {
+		timeLeft = uint32((ttl + time.Second - 1) / time.Second)
+	}
+	return
+}
+
+// TTLDuration returns the time left with millisecond precision. 0 means the entry never expires.
+func (cache *Cache) TTLDuration(key []byte) (timeLeft time.Duration, err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
 	cache.locks[segID].Lock()
 	timeLeft, err = cache.segments[segID].ttl(key, hashVal)
-	cache.locks[segID].Unlock()
+	cache.unlockSegment(segID)
 	return
 }
 
 func (cache *Cache) Del(key []byte) (affected bool) {
-	hashVal := hashFunc(key)
-	segID := hashVal & segmentAndOpVal
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
 	cache.locks[segID].Lock()
 	affected = cache.segments[segID].del(key, hashVal)
-	cache.locks[segID].Unlock()
+	cache.unlockSegment(segID)
 	return
 }
 
@@ -249,15 +335,54 @@ func (cache *Cache) TouchedCount() (touchedCount int64) {
 	return
 }
 
+// Resize changes the capacity of the cache to newSize bytes.
+// Segments are resized one at a time under their own lock, the newest entries
+// are kept as long as they fit and the dropped ones are counted as evictions.
+// Memory mapped caches keep the size of their file, resizing them returns ErrResizeMapped.
+func (cache *Cache) Resize(newSize int) error {
+	if cache.mapped != nil {
+		return ErrResizeMapped
+	}
+	if minSize := len(cache.segments) * minSegmentSize; newSize < minSize {
+		newSize = minSize
+	}
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		cache.segments[i].resize(newSize / len(cache.segments))
+		cache.unlockSegment(uint64(i))
+	}
+	return nil
+}
+
+// MaxEntrySize returns the largest size of a key and its value accepted by the cache,
+// larger entries are rejected with ErrLargeEntry. Compressed values are checked by their compressed size.
+func (cache *Cache) MaxEntrySize() int {
+	cache.locks[0].Lock()
+	size := cache.segments[0].maxKeyValLen()
+	cache.locks[0].Unlock()
+	return size
+}
+
 // Clear clears the cache.
 func (cache *Cache) Clear() {
 	for i := range cache.segments {
 		cache.locks[i].Lock()
 		cache.segments[i].clear()
-		cache.locks[i].Unlock()
+		cache.unlockSegment(uint64(i))
 	}
 }
 
+// Close stops the janitor and the background refreshes. A memory mapped cache is
+// also written to its file and unmapped. The cache must not be used after Close.
+func (cache *Cache) Close() error {
+	cache.stopJanitor()
+	cache.refresh.stop()
+	if cache.mapped != nil {
+		return cache.closeMapped()
+	}
+	return nil
+}
+
 // ResetStatistics refreshes the current state of the statistics.
 func (cache *Cache) ResetStatistics() {
 	for i := range cache.segments {
@@ -265,4 +390,8 @@ func (cache *Cache) ResetStatistics() {
 		cache.segments[i].resetStatistics()
 		cache.locks[i].Unlock()
 	}
+	cache.refresh.resetStatistics()
+	if cache.hot != nil {
+		cache.hot.reset()
+	}
 }
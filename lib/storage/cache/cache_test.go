@@ -0,0 +1,1184 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/godofcc/go-common/lib/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type mockTimer struct {
+	now uint32
+}
+
+func (timer *mockTimer) Now() uint32 {
+	return timer.now
+}
+
+type mockMilliTimer struct {
+	nowMs int64
+}
+
+func (timer *mockMilliTimer) Now() uint32 {
+	return uint32(timer.nowMs / 1000)
+}
+
+func (timer *mockMilliTimer) NowMilli() int64 {
+	return timer.nowMs
+}
+
+func TestSnapshot(t *testing.T) {
+	timer := &mockTimer{now: 100}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		expire := 0
+		if i%2 == 1 {
+			expire = 10
+		}
+		if err := cache.Set(key, key, expire); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snap")
+	if err := cache.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	timer.now += 20
+	restored := NewCacheCustomTimer(minBufSize, timer)
+	if err := restored.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if restored.EntryCount() != 500 {
+		t.Fatalf("entry count is %d, want 500", restored.EntryCount())
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		value, err := restored.Get(key)
+		if i%2 == 1 {
+			if err != ErrNotFound {
+				t.Fatalf("expired key %s was restored", key)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("get %s: value %s, err %v", key, value, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := cache.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewCacheCustomTimer(minBufSize*2, timer).LoadFrom(&buf); err != ErrSnapshotLayout {
+		t.Fatalf("load into a different layout: err %v, want %v", err, ErrSnapshotLayout)
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	timer := &mockTimer{now: 100}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	key := []byte("hot")
+	var calls int32
+	release := make(chan struct{})
+	loader := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("value"), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := cache.GetOrLoad(key, 0, loader)
+			if err != nil || string(value) != "value" {
+				t.Errorf("value %s, err %v", value, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("loader called %d times, want 1", calls)
+	}
+	if value, err := cache.Get(key); err != nil || string(value) != "value" {
+		t.Fatalf("loaded value was not cached: value %s, err %v", value, err)
+	}
+
+	cache.SetNegativeTTL(5)
+	loadErr := errors.New("backend down")
+	failing := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, loadErr
+	}
+	calls = 0
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetOrLoad([]byte("missing"), 0, failing); err != loadErr {
+			t.Fatalf("err %v, want %v", err, loadErr)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("failing loader called %d times, want 1", calls)
+	}
+	timer.now += 5
+	cache.GetOrLoad([]byte("missing"), 0, failing)
+	if calls != 2 {
+		t.Fatalf("negative entry did not expire")
+	}
+
+	// Negative entries and loaded values expire with millisecond precision.
+	milliTimer := &mockMilliTimer{nowMs: 100000}
+	cache = NewCacheCustomTimer(minBufSize, milliTimer)
+	cache.SetNegativeTTLDuration(200 * time.Millisecond)
+	calls = 0
+	cache.GetOrLoadWithTTL([]byte("missing"), 0, failing)
+	milliTimer.nowMs += 199
+	cache.GetOrLoadWithTTL([]byte("missing"), 0, failing)
+	if calls != 1 {
+		t.Fatalf("failing loader called %d times within the negative TTL", calls)
+	}
+	milliTimer.nowMs++
+	cache.GetOrLoadWithTTL([]byte("missing"), 0, failing)
+	if calls != 2 {
+		t.Fatalf("negative entry did not expire after 200ms")
+	}
+	value, err := cache.GetOrLoadWithTTL(key, 500*time.Millisecond, func() ([]byte, error) { return []byte("v"), nil })
+	if ttl, _ := cache.TTLDuration(key); err != nil || string(value) != "v" || ttl != 500*time.Millisecond {
+		t.Fatalf("loaded %q, %v with ttl %v", value, err, ttl)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	timer := &mockTimer{now: 100}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	reasons := make(map[string]EvictReason)
+	cache.OnEvict(func(key, value []byte, reason EvictReason) {
+		// The callback must run without the segment lock held.
+		cache.Get(key)
+		reasons[string(key)+"="+string(value)] = reason
+	})
+	cache.Set([]byte("a"), []byte("1"), 0)
+	cache.Set([]byte("a"), []byte("2"), 0)
+	cache.Set([]byte("b"), []byte("1"), 0)
+	cache.Del([]byte("b"))
+	cache.Set([]byte("c"), []byte("1"), 1)
+	timer.now += 2
+	cache.Get([]byte("c"))
+	cache.Clear()
+
+	expected := map[string]EvictReason{
+		"a=1": EvictReasonOverwritten,
+		"b=1": EvictReasonDeleted,
+		"c=1": EvictReasonExpired,
+		"a=2": EvictReasonCleared,
+	}
+	if len(reasons) != len(expected) {
+		t.Fatalf("got %v, want %v", reasons, expected)
+	}
+	for entry, reason := range expected {
+		if reasons[entry] != reason {
+			t.Fatalf("%s: reason %v, want %v", entry, reasons[entry], reason)
+		}
+	}
+
+	evicted := 0
+	cache.OnEvict(func(key, value []byte, reason EvictReason) {
+		if reason == EvictReasonCapacity {
+			evicted++
+		}
+	})
+	value := make([]byte, 100)
+	for i := 0; i < 10000; i++ {
+		cache.Set([]byte(fmt.Sprintf("key%d", i)), value, 0)
+	}
+	if evicted == 0 || int64(evicted) != 10000-cache.EntryCount() {
+		t.Fatalf("%d capacity evictions reported, %d entries left", evicted, cache.EntryCount())
+	}
+}
+
+func TestMultiOps(t *testing.T) {
+	cache := NewCache(minBufSize)
+	var keys, values [][]byte
+	for i := 0; i < 200; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key%d", i)))
+		values = append(values, []byte(fmt.Sprintf("value%d", i)))
+	}
+	for i, err := range cache.MultiSet(keys[:100], values[:100], 0) {
+		if err != nil {
+			t.Fatalf("set %s: %v", keys[i], err)
+		}
+	}
+	for _, err := range cache.MultiSet(keys[100:], values[100:150], 0) {
+		if err != ErrBatchLength {
+			t.Fatalf("set with missing values: %v", err)
+		}
+	}
+	got, found := cache.MultiGet(keys)
+	for i := range keys {
+		if found[i] != (i < 100) || !bytes.Equal(got[i], values[i]) && i < 100 {
+			t.Fatalf("get %s: value %s, found %v", keys[i], got[i], found[i])
+		}
+	}
+	affected := cache.MultiDel(keys[50:150])
+	for i, ok := range affected {
+		if ok != (i < 50) {
+			t.Fatalf("del %s: affected %v", keys[50+i], ok)
+		}
+	}
+	if cache.EntryCount() != 50 {
+		t.Fatalf("entry count is %d, want 50", cache.EntryCount())
+	}
+}
+
+func TestMilliTTL(t *testing.T) {
+	timer := &mockMilliTimer{nowMs: 100000}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	key := []byte("bucket")
+	if err := cache.SetWithTTL(key, []byte("1"), 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	timer.nowMs += 150
+	if ttl, err := cache.TTLDuration(key); err != nil || ttl != 50*time.Millisecond {
+		t.Fatalf("ttl %v, err %v", ttl, err)
+	}
+	if ttl, err := cache.TTL(key); err != nil || ttl != 1 {
+		t.Fatalf("ttl in seconds %v, err %v", ttl, err)
+	}
+	timer.nowMs += 50
+	if _, err := cache.Get(key); err != ErrNotFound {
+		t.Fatalf("entry did not expire after 200ms: %v", err)
+	}
+
+	// A Timer without millisecond support expires entries with second precision.
+	secTimer := &mockTimer{now: 100}
+	cache = NewCacheCustomTimer(minBufSize, secTimer)
+	cache.Set(key, []byte("1"), 2)
+	if _, expireAt, err := cache.GetWithExpiration(key); err != nil || expireAt != 102 {
+		t.Fatalf("expireAt %v, err %v", expireAt, err)
+	}
+	secTimer.now += 2
+	if _, err := cache.Get(key); err != ErrNotFound {
+		t.Fatalf("entry did not expire: %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	cache := NewCache(minBufSize)
+	value := make([]byte, 100)
+	set := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := cache.Set([]byte(fmt.Sprintf("key%d", i)), value, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set(0, 2000)
+	count, evacuated := cache.EntryCount(), cache.EvacuateCount()
+	if err := cache.Resize(minBufSize * 4); err != nil {
+		t.Fatal(err)
+	}
+	if cache.EntryCount() != count || cache.EvacuateCount() != evacuated {
+		t.Fatalf("growing dropped %d entries", count-cache.EntryCount())
+	}
+	set(2000, 8000)
+
+	count, evacuated = cache.EntryCount(), cache.EvacuateCount()
+	if err := cache.Resize(minBufSize); err != nil {
+		t.Fatal(err)
+	}
+	dropped := count - cache.EntryCount()
+	if dropped <= 0 || cache.EvacuateCount()-evacuated != dropped {
+		t.Fatalf("shrinking dropped %d entries and counted %d evictions", dropped, cache.EvacuateCount()-evacuated)
+	}
+	found := int64(0)
+	for i := 0; i < 8000; i++ {
+		if v, err := cache.Get([]byte(fmt.Sprintf("key%d", i))); err == nil {
+			if !bytes.Equal(v, value) {
+				t.Fatalf("key%d has a corrupted value", i)
+			}
+			found++
+		}
+	}
+	if found != cache.EntryCount() {
+		t.Fatalf("found %d entries, entry count is %d", found, cache.EntryCount())
+	}
+	set(8000, 12000)
+}
+
+func TestPrefix(t *testing.T) {
+	cache := NewCache(minBufSize)
+	for i := 0; i < 10; i++ {
+		for _, field := range []string{"profile", "settings"} {
+			key := fmt.Sprintf("user:%d:%s", i, field)
+			cache.Set([]byte(key), []byte(key), 0)
+		}
+	}
+	var scanned []string
+	cache.ScanPrefix([]byte("user:1:"), func(entry *Entry) bool {
+		scanned = append(scanned, string(entry.Key))
+		return true
+	})
+	if len(scanned) != 2 {
+		t.Fatalf("scanned %v", scanned)
+	}
+	if deleted := cache.DelPrefix([]byte("user:1:")); deleted != 2 {
+		t.Fatalf("deleted %d entries, want 2", deleted)
+	}
+	if _, err := cache.Get([]byte("user:2:profile")); err == ErrNotFound {
+		t.Fatal("DelPrefix deleted a key outside the prefix")
+	}
+
+	it := cache.NewIteratorWithFilter(func(key []byte) bool {
+		return bytes.HasSuffix(key, []byte(":settings"))
+	})
+	count := 0
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		if !bytes.HasSuffix(entry.Key, []byte(":settings")) {
+			t.Fatalf("filter returned %s", entry.Key)
+		}
+		if !it.Delete() {
+			t.Fatalf("failed to delete %s", entry.Key)
+		}
+		count++
+	}
+	if count != 9 || cache.EntryCount() != 9 {
+		t.Fatalf("iterated %d entries, %d left", count, cache.EntryCount())
+	}
+}
+
+type countingHasher struct {
+	calls int64
+}
+
+func (hasher *countingHasher) Sum64(data []byte) uint64 {
+	atomic.AddInt64(&hasher.calls, 1)
+	return xxHasher{}.Sum64(data)
+}
+
+func TestOptions(t *testing.T) {
+	for _, segments := range []int{1, 3, 1024} {
+		hasher := &countingHasher{}
+		cache := NewCacheWithOptions(Options{
+			Size:          1024 * 1024,
+			Segments:      segments,
+			Hasher:        hasher,
+			MaxEntryRatio: 0.5,
+		})
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			if err := cache.Set(key, key, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		count := 0
+		it := cache.NewIterator()
+		for entry := it.Next(); entry != nil; entry = it.Next() {
+			count++
+		}
+		if count != 100 || cache.EntryCount() != 100 {
+			t.Fatalf("%d segments: iterated %d entries, entry count %d", segments, count, cache.EntryCount())
+		}
+		if hasher.calls != 100 {
+			t.Fatalf("%d segments: custom hasher called %d times", segments, hasher.calls)
+		}
+		segSize := len(cache.segments[0].rb.data)
+		if err := cache.Set([]byte("big"), make([]byte, segSize/3), 0); err != nil {
+			t.Fatalf("%d segments: entry below MaxEntryRatio rejected: %v", segments, err)
+		}
+		if err := cache.Set([]byte("bigger"), make([]byte, segSize/2), 0); err != ErrLargeEntry {
+			t.Fatalf("%d segments: entry above MaxEntryRatio accepted: %v", segments, err)
+		}
+	}
+}
+
+func TestAverageAccessTime(t *testing.T) {
+	timer := &mockTimer{now: 100}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	cache.Set([]byte("a"), []byte("1"), 0)
+	timer.now = 200
+	cache.Set([]byte("b"), []byte("2"), 0)
+	// Every appended entry is counted, evacuate compares access times with this average.
+	if avg := cache.AverageAccessTime(); avg != 150 {
+		t.Fatalf("average access time %d", avg)
+	}
+	timer.now = 300
+	cache.Set([]byte("a"), []byte("3"), 0)
+	if avg := cache.AverageAccessTime(); avg != 250 {
+		t.Fatalf("average access time after an overwrite %d", avg)
+	}
+}
+
+func TestAdmissionTinyLFU(t *testing.T) {
+	hotKeysLeft := func(policy AdmissionPolicy) int {
+		cache := NewCacheWithOptions(Options{Size: 64 * 1024, Segments: 1, Admission: policy})
+		value := make([]byte, 100)
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("hot%d", i))
+				if _, err := cache.Get(key); err != nil {
+					cache.Set(key, value, 0)
+				}
+			}
+		}
+		var rejected int64
+		for i := 0; i < 5000; i++ {
+			if err := cache.Set([]byte(fmt.Sprintf("cold%d", i)), value, 0); err == ErrNotAdmitted {
+				rejected++
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		left := 0
+		for i := 0; i < 100; i++ {
+			if _, err := cache.Get([]byte(fmt.Sprintf("hot%d", i))); err == nil {
+				left++
+			}
+		}
+		if policy == AdmissionTinyLFU && cache.RejectedCount() == 0 {
+			t.Fatal("no cold entry was rejected")
+		}
+		if rejected != cache.RejectedCount() {
+			t.Fatalf("%d writes returned ErrNotAdmitted, %d rejected", rejected, cache.RejectedCount())
+		}
+		return left
+	}
+	lru, lfu := hotKeysLeft(AdmissionAlways), hotKeysLeft(AdmissionTinyLFU)
+	t.Logf("hot keys left: %d with TinyLFU, %d without", lfu, lru)
+	if lfu < 90 || lfu <= lru {
+		t.Fatalf("hot keys left after a scan: %d with TinyLFU, %d without", lfu, lru)
+	}
+}
+
+func TestAdmissionPinned(t *testing.T) {
+	cache := NewCacheWithOptions(Options{Size: 64 * 1024, Segments: 1, Admission: AdmissionTinyLFU})
+	value := make([]byte, 100)
+	if err := cache.SetPinned([]byte("pinned"), value, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		cache.Get([]byte("pinned"))
+	}
+	for i := 0; i < 1000; i++ {
+		cache.Set([]byte(fmt.Sprintf("cold%d", i)), value, 0)
+	}
+	// The popular pinned entry is not evicted, so it does not keep warmer keys out.
+	for i := 0; i < 3; i++ {
+		cache.Get([]byte("warm"))
+	}
+	if err := cache.Set([]byte("warm"), value, 0); err != nil {
+		t.Fatalf("set warm: %v", err)
+	}
+	if _, err := cache.Get([]byte("pinned")); err != nil {
+		t.Fatalf("get pinned: %v", err)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	cache := NewCache(minBufSize)
+	key := []byte("counter")
+	v1, err := cache.CompareAndSet(key, []byte("1"), 0, 0)
+	if err != nil || v1 == 0 {
+		t.Fatalf("create: version %d, err %v", v1, err)
+	}
+	if _, err := cache.CompareAndSet(key, []byte("1"), 0, 0); err != ErrVersionMismatch {
+		t.Fatalf("create of an existing key: err %v", err)
+	}
+	value, version, err := cache.GetWithVersion(key)
+	if err != nil || string(value) != "1" || version != v1 {
+		t.Fatalf("get: value %s, version %d, err %v", value, version, err)
+	}
+	v2, err := cache.CompareAndSet(key, []byte("2"), v1, 0)
+	if err != nil || v2 == v1 {
+		t.Fatalf("update: version %d, err %v", v2, err)
+	}
+	if _, err := cache.CompareAndSet(key, []byte("3"), v1, 0); err != ErrVersionMismatch {
+		t.Fatalf("update with a stale version: err %v", err)
+	}
+	cache.Del(key)
+	cache.Set(key, []byte("4"), 0)
+	if _, version, _ := cache.GetWithVersion(key); version == v1 || version == v2 {
+		t.Fatalf("re-created key reused version %d", version)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	timer := &mockMilliTimer{nowMs: 100000}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	key := []byte("ip:10.0.0.1")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := cache.Incr(key, 2, time.Second); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, err := cache.Decr(key, 1000, time.Second); err != nil || value != 1000 {
+		t.Fatalf("value %d, err %v", value, err)
+	}
+
+	timer.nowMs += 900
+	cache.Incr(key, 1, time.Second)
+	if ttl, _ := cache.TTLDuration(key); ttl != 100*time.Millisecond {
+		t.Fatalf("Incr changed the ttl to %v", ttl)
+	}
+	cache.IncrAndTouch(key, 1, time.Second)
+	if ttl, _ := cache.TTLDuration(key); ttl != time.Second {
+		t.Fatalf("IncrAndTouch set the ttl to %v", ttl)
+	}
+	if value, err := cache.GetCounter(key); err != nil || value != 1002 {
+		t.Fatalf("value %d, err %v", value, err)
+	}
+
+	cache.Set([]byte("text"), []byte("abc"), 0)
+	if _, err := cache.Incr([]byte("text"), 1, 0); err != ErrNotCounter {
+		t.Fatalf("incr of a non counter value: err %v", err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	cache := NewCache(minBufSize)
+	cache.SetWithTags([]byte("resp:1"), []byte("a"), 0, "user:1", "org:1")
+	cache.SetWithTags([]byte("resp:2"), []byte("b"), 0, "user:2", "org:1")
+	cache.SetWithTags([]byte("resp:3"), []byte("c"), 0, "user:2")
+	cache.Set([]byte("plain"), []byte("d"), 0)
+
+	cache.InvalidateTag("org:1")
+	if _, err := cache.Get([]byte("resp:1")); err != ErrNotFound {
+		t.Fatalf("get of an invalidated entry: err %v", err)
+	}
+	if err := cache.GetFn([]byte("resp:2"), func([]byte) error { return nil }); err != ErrNotFound {
+		t.Fatalf("GetFn of an invalidated entry: err %v", err)
+	}
+	var keys []string
+	it := cache.NewIterator()
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		keys = append(keys, string(entry.Key))
+	}
+	if len(keys) != 2 {
+		t.Fatalf("iterator returned %v", keys)
+	}
+	if value, err := cache.Get([]byte("resp:3")); err != nil || string(value) != "c" {
+		t.Fatalf("entry with other tags: value %s, err %v", value, err)
+	}
+
+	cache.SetWithTags([]byte("resp:1"), []byte("a2"), 0, "org:1")
+	if value, err := cache.Get([]byte("resp:1")); err != nil || string(value) != "a2" {
+		t.Fatalf("entry written after the invalidation: value %s, err %v", value, err)
+	}
+	cache.Set([]byte("resp:1"), []byte("a3"), 0)
+	cache.InvalidateTag("org:1")
+	if value, err := cache.Get([]byte("resp:1")); err != nil || string(value) != "a3" {
+		t.Fatalf("overwritten without tags: value %s, err %v", value, err)
+	}
+
+	var buf bytes.Buffer
+	if err := cache.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewCache(minBufSize)
+	if err := restored.LoadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Get([]byte("resp:2")); err != ErrNotFound {
+		t.Fatalf("invalidated entry after a snapshot: err %v", err)
+	}
+	if value, err := restored.Get([]byte("resp:3")); err != nil || string(value) != "c" {
+		t.Fatalf("tagged entry after a snapshot: value %s, err %v", value, err)
+	}
+
+	cache.SetWithTags([]byte("old"), []byte("e"), 0, "other")
+	for i := 0; i <= maxInvalidatedTags; i++ {
+		cache.InvalidateTag(strconv.Itoa(i))
+	}
+	if n := len(cache.tags.invalidated); n > maxInvalidatedTags/2+1 {
+		t.Fatalf("%d invalidated tags kept", n)
+	}
+	if _, err := cache.Get([]byte("old")); err != ErrNotFound {
+		t.Fatalf("entry older than the pruned invalidations: err %v", err)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.mmap")
+
+	cache, err := NewCacheMmap(path, minBufSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		cache.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), 0)
+	}
+	cache.Del([]byte("key0"))
+	if err = cache.Resize(minBufSize * 2); err != ErrResizeMapped {
+		t.Fatalf("resize mapped cache %v", err)
+	}
+	if err = cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = NewCacheMmap(path, minBufSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get([]byte("key0")); err != ErrNotFound {
+		t.Fatalf("deleted entry after reopen: err %v", err)
+	}
+	for i := 1; i < 1000; i++ {
+		value, err := cache.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("key%d after reopen: value %s, err %v", i, value, err)
+		}
+	}
+	if cache.EntryCount() != 999 {
+		t.Fatalf("entry count after reopen %d", cache.EntryCount())
+	}
+
+	// A file that was not closed is not trusted.
+	unclean, err := NewCacheMmap(path, minBufSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unclean.EntryCount() != 0 {
+		t.Fatalf("entry count of an unclean file %d", unclean.EntryCount())
+	}
+	unclean.Close()
+	cache.Close()
+
+	if _, err := NewCacheMmap(path, minBufSize*2); err != ErrMmapLayout {
+		t.Fatalf("reopen with another size: err %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	cache := NewCacheWithOptions(Options{Size: 64 * 1024, Segments: 1, Compression: CompressionFlate})
+	large := bytes.Repeat([]byte(`{"id":1,"name":"cache"},`), 2000)
+	if err := cache.Set([]byte("large"), large, 0); err != nil {
+		t.Fatalf("set of a compressible value larger than the entry limit: %v", err)
+	}
+	cache.Set([]byte("small"), []byte("raw"), 0)
+
+	if value, err := cache.Get([]byte("large")); err != nil || !bytes.Equal(value, large) {
+		t.Fatalf("Get: len %d, err %v", len(value), err)
+	}
+	buf := make([]byte, 0, len(large))
+	if value, err := cache.GetWithBuf([]byte("large"), buf); err != nil || !bytes.Equal(value, large) || &value[0] != &buf[:1][0] {
+		t.Fatalf("GetWithBuf: len %d, err %v", len(value), err)
+	}
+	err := cache.GetFn([]byte("large"), func(value []byte) error {
+		if !bytes.Equal(value, large) {
+			t.Fatalf("GetFn: len %d", len(value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := cache.Get([]byte("small")); err != nil || string(value) != "raw" {
+		t.Fatalf("small value: %s, err %v", value, err)
+	}
+	if ratio := cache.CompressionRatio(); ratio < 5 {
+		t.Fatalf("compression ratio %f", ratio)
+	}
+	if _, err := cache.Incr([]byte("large"), 1, 0); err != ErrNotCounter {
+		t.Fatalf("Incr of a compressed value: %v", err)
+	}
+}
+
+func TestGetWithVersionDecoded(t *testing.T) {
+	compressed := NewCacheWithOptions(Options{Size: 4 * 1024 * 1024, Compression: CompressionFlate})
+	encrypted := NewCache(4 * 1024 * 1024)
+	if err := encrypted.SetEncryptionKey(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("secret"), 150)
+	for _, cache := range []*Cache{compressed, encrypted} {
+		if _, err := cache.CompareAndSet([]byte("key"), value, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, version, err := cache.GetWithVersion([]byte("key")); err != nil || version == 0 || !bytes.Equal(got, value) {
+			t.Fatalf("GetWithVersion: len %d, version %d, err %v", len(got), version, err)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	cache := NewCache(minBufSize)
+	cache.Set([]byte("plain"), []byte("value"), 0)
+	if err := cache.SetEncryptionKey([]byte("short")); err == nil {
+		t.Fatal("SetEncryptionKey accepted an invalid key")
+	}
+	if err := cache.SetEncryptionKey(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get([]byte("plain")); err != ErrNotFound {
+		t.Fatalf("entry written without encryption: err %v", err)
+	}
+	secret := []byte("token-1234567890")
+	cache.Set([]byte("secret"), secret, 0)
+	var found bool
+	for i := range cache.segments {
+		if bytes.Contains(cache.segments[i].rb.data, secret) {
+			found = true
+		}
+	}
+	if found {
+		t.Fatal("the value is stored in plain text")
+	}
+	buf := make([]byte, 0, 64)
+	if value, err := cache.GetWithBuf([]byte("secret"), buf); err != nil || !bytes.Equal(value, secret) {
+		t.Fatalf("GetWithBuf: value %s, err %v", value, err)
+	}
+	if _, err := cache.Incr([]byte("counter"), 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := cache.Incr([]byte("counter"), 3, 0); err != nil || value != 5 {
+		t.Fatalf("Incr of an encrypted counter: value %d, err %v", value, err)
+	}
+
+	if err := cache.SetEncryptionKey(bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get([]byte("secret")); err != ErrNotFound {
+		t.Fatalf("entry written under the old key: err %v", err)
+	}
+	cache.Set([]byte("secret"), secret, 0)
+	if value, err := cache.Get([]byte("secret")); err != nil || !bytes.Equal(value, secret) {
+		t.Fatalf("entry written under the new key: value %s, err %v", value, err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := cache.SaveTo(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	restore := func(key []byte) *Cache {
+		restored := NewCache(minBufSize)
+		restored.SetEncryptionKey(key)
+		if err := restored.LoadFrom(bytes.NewReader(snapshot.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		return restored
+	}
+	if value, err := restore(bytes.Repeat([]byte{2}, 16)).Get([]byte("secret")); err != nil || !bytes.Equal(value, secret) {
+		t.Fatalf("restored under the same key: value %s, err %v", value, err)
+	}
+	// A different key with the same fingerprint.
+	other := bytes.Repeat([]byte{3}, 16)
+	for other[0] = 0; keyFingerprint(other) != keyFingerprint(bytes.Repeat([]byte{2}, 16)); other[0]++ {
+	}
+	restored := restore(other)
+	if _, err := restored.Get([]byte("secret")); err != ErrNotFound || restored.EntryCount() != 0 {
+		t.Fatalf("restored under a colliding key: err %v, %d entries", err, restored.EntryCount())
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	timer := &mockMilliTimer{nowMs: 100000}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	defer cache.Close()
+	release := make(chan struct{})
+	var calls int32
+	cache.SetRefresher(func(key []byte) ([]byte, time.Duration, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("fresh"), time.Second, 10 * time.Second, nil
+	}, 2)
+	cache.SetWithSoftTTL([]byte("key"), []byte("stale"), time.Second, 10*time.Second)
+
+	if value, _ := cache.Get([]byte("key")); string(value) != "stale" {
+		t.Fatalf("value before the soft ttl %s", value)
+	}
+	timer.nowMs += 2000
+	for i := 0; i < 10; i++ {
+		if value, err := cache.Get([]byte("key")); err != nil || string(value) != "stale" {
+			t.Fatalf("value after the soft ttl: %s, err %v", value, err)
+		}
+	}
+	close(release)
+	for cache.RefreshCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if value, _ := cache.Get([]byte("key")); string(value) != "fresh" {
+		t.Fatalf("value after the refresh %s", value)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("refresher called %d times", n)
+	}
+	if cache.StaleHitCount() != 10 {
+		t.Fatalf("stale hit count %d", cache.StaleHitCount())
+	}
+
+	cache.SetRefresher(nil, 0)
+	cache.SetWithSoftTTL([]byte("key"), []byte("stale"), time.Second, 10*time.Second)
+	timer.nowMs += 11000
+	if _, err := cache.Get([]byte("key")); err != ErrNotFound {
+		t.Fatalf("entry after the hard ttl: err %v", err)
+	}
+}
+
+func TestEntryTrailer(t *testing.T) {
+	timer := &mockMilliTimer{nowMs: 100000}
+	cache := NewCacheWithOptions(Options{Size: 4 * 1024 * 1024, Timer: timer, Compression: CompressionFlate})
+	cache.SetEncryptionKey(bytes.Repeat([]byte{1}, 16))
+	large := bytes.Repeat([]byte("compressible"), 200)
+	cache.SetWithSoftTTL([]byte("delta"), large, time.Second, 10*time.Second)
+	cache.SetWithSoftTTL([]byte("absolute"), []byte("v"), time.Second, 0)
+	cache.SetWithTags([]byte("tagged"), large, 0, "t")
+	cache.Set([]byte("plain"), []byte("v"), 0)
+	// Overwritten in place with a smaller trailer.
+	cache.SetWithTags([]byte("plain"), []byte("w"), 0)
+
+	for _, key := range []string{"delta", "tagged"} {
+		if value, err := cache.Get([]byte(key)); err != nil || !bytes.Equal(value, large) {
+			t.Fatalf("%s: len %d, err %v", key, len(value), err)
+		}
+	}
+	if cache.StaleHitCount() != 0 {
+		t.Fatalf("stale hits before the soft ttl %d", cache.StaleHitCount())
+	}
+	timer.nowMs += 2000
+	cache.Get([]byte("delta"))
+	cache.Get([]byte("absolute"))
+	if cache.StaleHitCount() != 2 {
+		t.Fatalf("stale hits after the soft ttl %d", cache.StaleHitCount())
+	}
+	cache.InvalidateTag("t")
+	if _, err := cache.Get([]byte("tagged")); err != ErrNotFound {
+		t.Fatalf("invalidated entry: err %v", err)
+	}
+	if value, err := cache.Get([]byte("plain")); err != nil || string(value) != "w" {
+		t.Fatalf("plain: %s, err %v", value, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	timer := &mockMilliTimer{nowMs: 100000}
+	cache := NewCacheCustomTimer(minBufSize, timer)
+	events, cancel := cache.Subscribe(func(key []byte) bool {
+		return bytes.HasPrefix(key, []byte("watched:"))
+	})
+	cache.Set([]byte("watched:1"), []byte("a"), 1)
+	cache.Set([]byte("other"), []byte("b"), 0)
+	cache.Set([]byte("watched:2"), []byte("c"), 0)
+	cache.Del([]byte("watched:2"))
+	timer.nowMs += 2000
+	cache.Get([]byte("watched:1"))
+
+	want := []Event{
+		{Type: EventSet, Key: []byte("watched:1")},
+		{Type: EventSet, Key: []byte("watched:2")},
+		{Type: EventDelete, Key: []byte("watched:2"), Reason: EvictReasonDeleted},
+		{Type: EventExpire, Key: []byte("watched:1"), Reason: EvictReasonExpired},
+	}
+	for _, w := range want {
+		e := <-events
+		if e.Type != w.Type || !bytes.Equal(e.Key, w.Key) || e.Reason != w.Reason {
+			t.Fatalf("event %v %s %v, want %v %s %v", e.Type, e.Key, e.Reason, w.Type, w.Key, w.Reason)
+		}
+	}
+
+	// A subscriber that does not read loses events instead of blocking the cache.
+	for i := 0; i < eventBufferSize+10; i++ {
+		cache.Set([]byte("watched:1"), []byte("a"), 0)
+	}
+	if cache.DroppedEventCount() != 10 {
+		t.Fatalf("dropped %d events", cache.DroppedEventCount())
+	}
+	cancel()
+	cancel()
+	n := 0
+	for range events {
+		n++
+	}
+	if n != eventBufferSize {
+		t.Fatalf("%d buffered events after cancel", n)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	cache := NewCache(minBufSize)
+	cache.Set([]byte("user:1"), []byte("alice"), 0)
+	cache.Set([]byte("user:2"), []byte("bob"), 100)
+	cache.Set([]byte("order:1"), []byte("x"), 0)
+	cache.Get([]byte("user:1"))
+	handler := NewAdminHandler(cache, AuthorizerFunc(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "secret"
+	}))
+	do := func(method, target string, auth bool, v interface{}) int {
+		r := httptest.NewRequest(method, target, nil)
+		if auth {
+			r.Header.Set("Authorization", "secret")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if v != nil && w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: %v", method, target, err)
+			}
+		}
+		return w.Code
+	}
+
+	var stats AdminStats
+	if code := do("GET", "/stats", false, &stats); code != http.StatusOK || stats.EntryCount != 3 || stats.HitRate != 1 {
+		t.Fatalf("stats: code %d, %+v", code, stats)
+	}
+	var entry AdminEntry
+	if code := do("GET", "/key?key=user:2", false, &entry); code != http.StatusOK || string(entry.Value) != "bob" || entry.TTL <= 0 {
+		t.Fatalf("lookup: code %d, %+v", code, entry)
+	}
+	if code := do("GET", "/key?key=user:3", false, nil); code != http.StatusNotFound {
+		t.Fatalf("lookup of a missing key: code %d", code)
+	}
+	var entries []AdminEntry
+	if code := do("GET", "/keys?prefix=user:", false, &entries); code != http.StatusOK || len(entries) != 2 {
+		t.Fatalf("list: code %d, %+v", code, entries)
+	}
+	if code := do("DELETE", "/key?key=user:1", false, nil); code != http.StatusForbidden {
+		t.Fatalf("unauthorized delete: code %d", code)
+	}
+	if code := do("DELETE", "/key?key=user:1", true, nil); code != http.StatusOK || cache.EntryCount() != 2 {
+		t.Fatalf("delete: code %d, entry count %d", code, cache.EntryCount())
+	}
+	if code := do("POST", "/reset-stats", true, nil); code != http.StatusOK || cache.HitCount() != 0 {
+		t.Fatalf("reset stats: code %d", code)
+	}
+	if code := do("POST", "/clear", false, nil); code != http.StatusForbidden || cache.EntryCount() != 2 {
+		t.Fatalf("unauthorized clear: code %d", code)
+	}
+	if code := do("POST", "/clear", true, nil); code != http.StatusOK || cache.EntryCount() != 0 {
+		t.Fatalf("clear: code %d, entry count %d", code, cache.EntryCount())
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	cache := NewCacheWithOptions(Options{Size: minBufSize, JanitorInterval: 5 * time.Millisecond})
+	for i := 0; i < 1000; i++ {
+		ttl := 20 * time.Millisecond
+		if i%10 == 0 {
+			ttl = 0
+		}
+		cache.SetWithTTL([]byte(fmt.Sprintf("key%d", i)), []byte("value"), ttl)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.EntryCount() != 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("entry count %d after the entries expired", cache.EntryCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cache.ExpiredCount() != 900 {
+		t.Fatalf("expired count %d", cache.ExpiredCount())
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+}
+
+func TestHotKeys(t *testing.T) {
+	cache := NewCacheWithOptions(Options{Size: minBufSize, Segments: 4, HotKeyCapacity: 8, HotKeySampleRate: 1})
+	cache.Set([]byte("hot"), []byte("v"), 0)
+	for i := 0; i < 1000; i++ {
+		cache.Get([]byte("hot"))
+		cache.Set([]byte(fmt.Sprintf("cold%d", i)), []byte("v"), 0)
+	}
+	cache.Set([]byte("big"), make([]byte, 10000), 0)
+
+	byAccess, byBytes := cache.HotKeys(3)
+	if len(byAccess) != 3 || byAccess[0].Key != "hot" || byAccess[0].Count < 1000 {
+		t.Fatalf("hot keys by access %+v", byAccess)
+	}
+	if len(byBytes) != 3 || byBytes[0].Key != "big" || byBytes[0].Count-byBytes[0].Error > 10000 || byBytes[0].Count < 10000 {
+		t.Fatalf("hot keys by bytes %+v", byBytes)
+	}
+	if n := len(cache.hot.access.counters) + len(cache.hot.written.counters); n > 16 {
+		t.Fatalf("%d keys tracked with a capacity of 8", n)
+	}
+	if a, _ := NewCache(minBufSize).HotKeys(3); a != nil {
+		t.Fatalf("hot keys without tracking %+v", a)
+	}
+
+	// Misses and rejected sets are not sampled, shared reads are.
+	cache = NewCacheWithOptions(Options{Size: minBufSize, HotKeyCapacity: 8, HotKeySampleRate: 1, ReadOptimized: true})
+	cache.Set([]byte("a"), []byte("v"), 0)
+	for i := 0; i < 10; i++ {
+		cache.Get([]byte("a"))
+		cache.Get([]byte("missing"))
+		if err := cache.Set([]byte("large"), make([]byte, minBufSize), 0); err != ErrLargeEntry {
+			t.Fatalf("set large %v", err)
+		}
+	}
+	byAccess, _ = cache.HotKeys(3)
+	if len(byAccess) != 1 || byAccess[0].Key != "a" || byAccess[0].Count != 11 {
+		t.Fatalf("hot keys by access %+v", byAccess)
+	}
+}
+
+func TestReadOptimized(t *testing.T) {
+	timer := &mockTimer{now: 100}
+	cache := NewCacheWithOptions(Options{Size: minBufSize, Timer: timer, ReadOptimized: true})
+	cache.Set([]byte("a"), []byte("1"), 10)
+	cache.Set([]byte("b"), []byte("2"), 0)
+	if v, err := cache.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("get %q %v", v, err)
+	}
+	if _, err := cache.Get([]byte("c")); err != ErrNotFound {
+		t.Fatalf("get missing %v", err)
+	}
+	if err := cache.GetFn([]byte("b"), func(v []byte) error {
+		if string(v) != "2" {
+			t.Fatalf("get fn %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, expireAt, err := cache.GetWithExpiration([]byte("a")); err != nil || expireAt != 110 {
+		t.Fatalf("expire at %d %v", expireAt, err)
+	}
+	if cache.HitCount() != 3 || cache.MissCount() != 1 {
+		t.Fatalf("hits %d misses %d", cache.HitCount(), cache.MissCount())
+	}
+	timer.now = 200
+	if _, err := cache.Get([]byte("a")); err != ErrNotFound || cache.ExpiredCount() != 1 {
+		t.Fatalf("get expired %v, expired count %d", err, cache.ExpiredCount())
+	}
+	// The stale access time is refreshed under the write lock.
+	if v, err := cache.Get([]byte("b")); err != nil || string(v) != "2" {
+		t.Fatalf("get %q %v", v, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := []byte(strconv.Itoa(j % 100))
+				if i == 0 {
+					cache.Set(key, key, 0)
+				} else if v, err := cache.Get(key); err == nil && !bytes.Equal(v, key) {
+					t.Errorf("get %q: %q", key, v)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func benchmarkParallelGet(b *testing.B, opts Options) {
+	opts.Size = 64 * 1024 * 1024
+	cache := NewCacheWithOptions(opts)
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i))
+		cache.Set(keys[i], make([]byte, 128), 0)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 128)
+		var i int
+		for pb.Next() {
+			cache.GetWithBuf(keys[i&1023], buf)
+			i++
+		}
+	})
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	benchmarkParallelGet(b, Options{})
+}
+
+func BenchmarkParallelGetReadOptimized(b *testing.B) {
+	benchmarkParallelGet(b, Options{ReadOptimized: true})
+}
+
+func TestPinned(t *testing.T) {
+	cache := NewCacheWithOptions(Options{Size: minBufSize, Segments: 1, MaxPinnedRatio: 0.1})
+	value := make([]byte, 1000)
+	for i := 0; i < 10; i++ {
+		if err := cache.SetPinned([]byte(fmt.Sprintf("pinned%d", i)), value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.SetPinned([]byte("big"), make([]byte, 50000), 0); err != ErrPinnedLimit {
+		t.Fatalf("set over the pinned limit %v", err)
+	}
+	for i := 0; i < 5000; i++ {
+		cache.Set([]byte(fmt.Sprintf("cold%d", i)), value, 0)
+	}
+	if cache.EvacuateCount() == 0 {
+		t.Fatal("no entries evacuated")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := cache.Get([]byte(fmt.Sprintf("pinned%d", i))); err != nil {
+			t.Fatalf("pinned entry %d: %v", i, err)
+		}
+	}
+	if cache.PinnedCount() != 10 || cache.PinnedBytes() < 10000 {
+		t.Fatalf("pinned count %d bytes %d", cache.PinnedCount(), cache.PinnedBytes())
+	}
+
+	var buf bytes.Buffer
+	if err := cache.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewCacheWithOptions(Options{Size: minBufSize, Segments: 1, MaxPinnedRatio: 0.1})
+	if err := restored.LoadFrom(&buf); err != nil || restored.PinnedCount() != 10 {
+		t.Fatalf("restored pinned count %d %v", restored.PinnedCount(), err)
+	}
+
+	cache.Set([]byte("pinned0"), value, 0)
+	cache.Del([]byte("pinned1"))
+	if err := cache.Unpin([]byte("pinned2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Unpin([]byte("missing")); err != ErrNotFound {
+		t.Fatalf("unpin missing %v", err)
+	}
+	if cache.PinnedCount() != 7 {
+		t.Fatalf("pinned count %d", cache.PinnedCount())
+	}
+
+	// Growing pinned entries stay within the limit.
+	cache = NewCacheWithOptions(Options{Size: minBufSize, Segments: 1})
+	var n int
+	for ; cache.SetPinned([]byte(strconv.Itoa(n)), make([]byte, 100), 0) == nil; n++ {
+	}
+	for i := 0; i < n; i++ {
+		cache.SetPinned([]byte(strconv.Itoa(i)), make([]byte, 101), 0)
+	}
+	if limit := int64(minBufSize / 2); cache.PinnedBytes() > limit {
+		t.Fatalf("%d pinned bytes, limit %d", cache.PinnedBytes(), limit)
+	}
+}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrDecrypt = errors.New("The entry could not be decrypted")
+
+// nonceSize is the size of the AES-GCM nonce stored in front of every encrypted value.
+const nonceSize = 12
+
+// cipherKey encrypts values with one key.
+// Nonces are a random prefix chosen with the key followed by a counter,
+// so they never repeat for the key.
+type cipherKey struct {
+	counter uint64
+	id      uint8 // fingerprint of the key stored in the header of the entries encrypted with it.
+	prefix  [4]byte
+	aead    cipher.AEAD
+}
+
+// valueCipher holds the key of a cache, entries written under another key are invalidated.
+type valueCipher struct {
+	mu      sync.Mutex   // serializes SetEncryptionKey.
+	current atomic.Value // *cipherKey, nil if values are not encrypted.
+}
+
+func (c *valueCipher) init() {
+	c.current.Store((*cipherKey)(nil))
+}
+
+func (c *valueCipher) key() *cipherKey {
+	return c.current.Load().(*cipherKey)
+}
+
+// keyID returns the id of the current key, 0 if values are not encrypted.
+func (c *valueCipher) keyID() uint8 {
+	if k := c.key(); k != nil {
+		return k.id
+	}
+	return 0
+}
+
+// SetEncryptionKey encrypts the values written from now on with AES-GCM under key,
+// which must be 16, 24 or 32 bytes long. Entries written under a previous key, or
+// without encryption, are invalidated. A nil key turns encryption off.
+// Entries are tagged with an 8 bit fingerprint of their key, so entries restored from a
+// snapshot or a memory mapped file stay readable under the same key. Entries of another
+// key whose fingerprint collides fail to decrypt and are dropped as misses.
+// Encrypted values take 28 more bytes, compressed values are compressed before encryption.
+func (cache *Cache) SetEncryptionKey(key []byte) error {
+	c := &cache.cipher
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key == nil {
+		c.current.Store((*cipherKey)(nil))
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k := &cipherKey{aead: aead}
+	if _, err = rand.Read(k.prefix[:]); err != nil {
+		return err
+	}
+	k.id = keyFingerprint(key)
+	c.current.Store(k)
+	return nil
+}
+
+// keyFingerprint returns the id of a key, never 0 which marks unencrypted entries.
+func keyFingerprint(key []byte) uint8 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("cache key id"))
+	return mac.Sum(nil)[0]%255 + 1
+}
+
+// seal encrypts the value, the entry key is authenticated with it so the
+// value can not be moved to another entry.
+func (k *cipherKey) seal(value, key []byte) []byte {
+	out := make([]byte, nonceSize, nonceSize+len(value)+k.aead.Overhead())
+	copy(out, k.prefix[:])
+	binary.LittleEndian.PutUint64(out[4:], atomic.AddUint64(&k.counter, 1))
+	return k.aead.Seal(out, out[:nonceSize], value, key)
+}
+
+// open decrypts a value sealed with the key, appending it to dst.
+func (k *cipherKey) open(dst, stored, key []byte) ([]byte, error) {
+	if len(stored) < nonceSize {
+		return nil, ErrDecrypt
+	}
+	value, err := k.aead.Open(dst, stored[:nonceSize], stored[nonceSize:], key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return value, nil
+}
+
+// decrypt opens the stored value of the entry at offset, appending it to dst.
+func (seg *segment) decrypt(hdr *entryHdr, keyId uint8, offset int64, stored, dst []byte) ([]byte, error) {
+	k := seg.cipher.key()
+	if k == nil || k.id != keyId {
+		return nil, ErrDecrypt
+	}
+	key := make([]byte, hdr.keyLen)
+	seg.rb.ReadAt(key, offset+ENTRY_HDR_SIZE)
+	return k.open(dst, stored, key)
+}
+
+// readFailed handles an error reading the value of the entry at offset.
+// A value that fails to decrypt was written under another key with the same id,
+// the entry is deleted unless peek is set and the read counts as a miss.
+func (seg *segment) readFailed(hdr *entryHdr, offset int64, err error, peek bool) error {
+	if err != ErrDecrypt {
+		return err
+	}
+	if !peek {
+		seg.recordEvict(hdr, offset, EvictReasonInvalidated)
+		seg.delEntryPtrByOffset(hdr.slotId, hdr.hash16, offset)
+		atomic.AddInt64(&seg.missCount, 1)
+	}
+	return ErrNotFound
+}
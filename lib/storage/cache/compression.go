@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrUnknownCodec = errors.New("The entry was compressed with an unknown codec")
+
+// Compression selects the codec used to compress large values.
+type Compression uint8
+
+const (
+	// CompressionNone stores values as they are.
+	CompressionNone Compression = iota
+	// CompressionFlate compresses values with DEFLATE at the fastest level.
+	CompressionFlate
+)
+
+// defaultCompressionThreshold is the smallest value compressed when Options.CompressionThreshold is 0.
+const defaultCompressionThreshold = 1024
+
+// compressor compresses the values of a segment that are at least threshold bytes long.
+type compressor struct {
+	codec     Compression
+	threshold int
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// storedValue is a value as it is written to the ring buffer, compressed and encrypted if enabled.
+type storedValue struct {
+	data   []byte
+	rawLen int
+	codec  Compression
+	keyId  uint8
+}
+
+// encodeValue compresses and encrypts the value of key. The setters call it before taking the
+// segment lock, only values computed under the lock, e.g. counters, are encoded with it held.
+func encodeValue(c *compressor, vc *valueCipher, key, value []byte) (v storedValue) {
+	v.rawLen = len(value)
+	v.data, v.codec = c.encode(value)
+	if vc != nil {
+		if k := vc.key(); k != nil {
+			v.data = k.seal(v.data, key)
+			v.keyId = k.id
+		}
+	}
+	return
+}
+
+func (cache *Cache) encodeValue(key, value []byte) storedValue {
+	return encodeValue(cache.compression, &cache.cipher, key, value)
+}
+
+func (seg *segment) encodeValue(key, value []byte) storedValue {
+	return encodeValue(seg.compression, seg.cipher, key, value)
+}
+
+// encode returns the value to store and the codec it was compressed with.
+// Values that do not get smaller are stored uncompressed.
+func (c *compressor) encode(value []byte) ([]byte, Compression) {
+	if c == nil || c.codec == CompressionNone || len(value) < c.threshold {
+		return value, CompressionNone
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(value) / 2)
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(value)
+	w.Close()
+	flateWriters.Put(w)
+	if buf.Len() >= len(value) {
+		return value, CompressionNone
+	}
+	return buf.Bytes(), c.codec
+}
+
+// decode decompresses a stored value of rawLen bytes into buf if it is large enough.
+func decode(codec Compression, stored, buf []byte, rawLen uint32) (value []byte, err error) {
+	if cap(buf) >= int(rawLen) {
+		value = buf[:rawLen]
+	} else {
+		value = make([]byte, rawLen)
+	}
+	switch codec {
+	case CompressionFlate:
+		r := flateReaders.Get().(io.ReadCloser)
+		r.(flate.Resetter).Reset(bytes.NewReader(stored), nil)
+		_, err = io.ReadFull(r, value)
+		flateReaders.Put(r)
+	default:
+		err = ErrUnknownCodec
+	}
+	return
+}
+
+// readValue returns the value of the entry at offset, decrypted and decompressed if needed.
+// The value is read into buf if it is large enough.
+func (seg *segment) readValue(hdr *entryHdr, offset int64, buf []byte) (value []byte, err error) {
+	start := offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
+	if hdr.plain() {
+		if cap(buf) >= int(hdr.valLen) {
+			value = buf[:hdr.valLen]
+		} else {
+			value = make([]byte, hdr.valLen)
+		}
+		_, err = seg.rb.ReadAt(value, start)
+		return
+	}
+	stored, err := seg.rb.Slice(start, int64(hdr.valLen))
+	if err != nil {
+		return
+	}
+	meta := seg.readMeta(hdr, offset)
+	if meta.keyId != 0 {
+		var dst []byte
+		if hdr.codec() == CompressionNone && cap(buf) >= int(hdr.valLen) {
+			dst = buf[:0]
+		}
+		if stored, err = seg.decrypt(hdr, meta.keyId, offset, stored, dst); err != nil {
+			return
+		}
+		if hdr.codec() == CompressionNone {
+			return stored, nil
+		}
+	}
+	return decode(hdr.codec(), stored, buf, meta.rawLen)
+}
+
+// CompressionRatio returns the uncompressed size of the values written compressed
+// divided by their stored size, 0 if no value was compressed.
+func (cache *Cache) CompressionRatio() float64 {
+	var raw, stored int64
+	for i := range cache.segments {
+		raw += atomic.LoadInt64(&cache.segments[i].compressedRaw)
+		stored += atomic.LoadInt64(&cache.segments[i].compressedStored)
+	}
+	if stored == 0 {
+		return 0
+	}
+	return float64(raw) / float64(stored)
+}
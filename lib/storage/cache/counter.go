@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+var ErrNotCounter = errors.New("The value is not an 8 byte counter")
+
+// Incr adds delta to the counter stored under key and returns the new value.
+// Counters are 8 byte little endian integers, as written by SetCounter.
+// A missing counter is created with the value delta and the given ttl,
+// an existing counter keeps its expiration.
+func (cache *Cache) Incr(key []byte, delta int64, ttl time.Duration) (value int64, err error) {
+	return cache.incr(key, delta, ttl, false)
+}
+
+// Decr subtracts delta from the counter stored under key, see Incr.
+func (cache *Cache) Decr(key []byte, delta int64, ttl time.Duration) (value int64, err error) {
+	return cache.incr(key, -delta, ttl, false)
+}
+
+// IncrAndTouch is like Incr but also resets the expiration of an existing counter to ttl.
+func (cache *Cache) IncrAndTouch(key []byte, delta int64, ttl time.Duration) (value int64, err error) {
+	return cache.incr(key, delta, ttl, true)
+}
+
+// SetCounter sets the counter stored under key to value.
+func (cache *Cache) SetCounter(key []byte, value int64, ttl time.Duration) (err error) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(value))
+	return cache.SetWithTTL(key, buf[:], ttl)
+}
+
+// GetCounter returns the counter stored under key.
+func (cache *Cache) GetCounter(key []byte) (value int64, err error) {
+	buf, err := cache.Get(key)
+	if err != nil {
+		return
+	}
+	if len(buf) != 8 {
+		return 0, ErrNotCounter
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (cache *Cache) incr(key []byte, delta int64, ttl time.Duration, touch bool) (value int64, err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	cache.locks[segID].Lock()
+	value, err = cache.segments[segID].incr(key, hashVal, delta, ttl, touch)
+	cache.unlockSegment(segID)
+	return
+}
+
+// incr updates the counter in place in the ring buffer.
+func (seg *segment) incr(key []byte, hashVal uint64, delta int64, ttl time.Duration, touch bool) (value int64, err error) {
+	hdr, ptr, err := seg.locate(key, hashVal, false)
+	var buf [8]byte
+	if err == ErrNotFound {
+		binary.LittleEndian.PutUint64(buf[:], uint64(delta))
+		return delta, seg.set(key, seg.encodeValue(key, buf[:]), hashVal, ttl)
+	}
+	if !hdr.plain() {
+		return seg.rewriteCounter(key, hdr, ptr, hashVal, delta, ttl, touch)
+	}
+	if hdr.valLen != 8 {
+		return 0, ErrNotCounter
+	}
+	valOff := ptr.offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
+	seg.rb.ReadAt(buf[:], valOff)
+	value = int64(binary.LittleEndian.Uint64(buf[:])) + delta
+	binary.LittleEndian.PutUint64(buf[:], uint64(value))
+	seg.rb.WriteAt(buf[:], valOff)
+	hdr.version = seg.nextVersion()
+	if touch {
+		hdr.expireAt = expireAtFor(nowMilli(seg.timer), ttl)
+	}
+	seg.rb.WriteAt((*[ENTRY_HDR_SIZE]byte)(unsafe.Pointer(hdr))[:], ptr.offset)
+	atomic.AddInt64(&seg.hitCount, 1)
+	seg.notify(EventSet, key, 0)
+	return
+}
+
+// rewriteCounter updates a counter whose stored value is encrypted or compressed
+// by writing it again.
+func (seg *segment) rewriteCounter(key []byte, hdr *entryHdr, ptr *entryPtr, hashVal uint64, delta int64, ttl time.Duration, touch bool) (value int64, err error) {
+	buf, err := seg.readValue(hdr, ptr.offset, nil)
+	if err != nil {
+		if err = seg.readFailed(hdr, ptr.offset, err, false); err != ErrNotFound {
+			return
+		}
+		var fresh [8]byte
+		binary.LittleEndian.PutUint64(fresh[:], uint64(delta))
+		return delta, seg.set(key, seg.encodeValue(key, fresh[:]), hashVal, ttl)
+	}
+	if len(buf) != 8 {
+		return 0, ErrNotCounter
+	}
+	if !touch {
+		ttl = 0
+		if hdr.expireAt != 0 {
+			if ttl = time.Duration(hdr.expireAt-nowMilli(seg.timer)) * time.Millisecond; ttl <= 0 {
+				ttl = time.Millisecond
+			}
+		}
+	}
+	value = int64(binary.LittleEndian.Uint64(buf)) + delta
+	binary.LittleEndian.PutUint64(buf, uint64(value))
+	if err = seg.set(key, seg.encodeValue(key, buf), hashVal, ttl); err == nil {
+		atomic.AddInt64(&seg.hitCount, 1)
+	}
+	return
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"encoding/binary"
+)
+
+// An entry is stored as its ENTRY_HDR_SIZE byte entryHdr, the key, the value and a trailer.
+// The header was 24 bytes until expireAt was kept in milliseconds, which grew it to 32 bytes,
+// 8 more bytes per entry. Features added since then keep their per-entry metadata in the flags
+// and the trailer instead of growing the header again, see entryMeta.
+
+// Bits of entryHdr.flags.
+const (
+	flagDeleted = 1 << iota
+	// flagPinned marks an entry kept by evacuate, see SetPinned.
+	flagPinned
+	// flagEncrypted means the trailer holds the id of the encryption key of the value.
+	flagEncrypted
+	// flagStaleDelta means the trailer holds staleAt as milliseconds before expireAt.
+	flagStaleDelta
+	// flagStaleAt means the trailer holds staleAt as Unix time in milliseconds.
+	flagStaleAt
+	// The Compression of the value takes the top bits, the trailer holds the raw length
+	// of compressed values.
+	flagCodecShift = 5
+)
+
+// maxMetaLen is the size of the largest trailer metadata.
+const maxMetaLen = 4 + 1 + 8
+
+// entryMeta is the optional metadata stored in the trailer after the value, followed by the
+// tag data. Only the fields selected by the flags of the entry are stored, so entries that
+// do not use compression, encryption or soft expiration do not pay for them.
+type entryMeta struct {
+	rawLen  uint32 // length of the value before compression.
+	keyId   uint8  // id of the encryption key of the value, 0 if it is not encrypted.
+	staleAt int64  // Unix time in milliseconds after which reads refresh the entry, 0 means never.
+}
+
+func (hdr *entryHdr) has(flag uint8) bool {
+	return hdr.flags&flag != 0
+}
+
+func (hdr *entryHdr) setFlag(flag uint8, on bool) {
+	if on {
+		hdr.flags |= flag
+	} else {
+		hdr.flags &^= flag
+	}
+}
+
+func (hdr *entryHdr) codec() Compression {
+	return Compression(hdr.flags >> flagCodecShift)
+}
+
+// plain reports whether the value is stored as it was set.
+func (hdr *entryHdr) plain() bool {
+	return hdr.codec() == CompressionNone && !hdr.has(flagEncrypted)
+}
+
+// metaLen returns the length of the metadata in the trailer.
+func (hdr *entryHdr) metaLen() int {
+	n := 0
+	if hdr.codec() != CompressionNone {
+		n += 4
+	}
+	if hdr.has(flagEncrypted) {
+		n++
+	}
+	if hdr.has(flagStaleDelta) {
+		n += 4
+	} else if hdr.has(flagStaleAt) {
+		n += 8
+	}
+	return n
+}
+
+// tagLen returns the length of the tag data stored after the metadata, see SetWithTags.
+func (hdr *entryHdr) tagLen() int {
+	return int(hdr.extLen) - hdr.metaLen()
+}
+
+// encodeMeta sets the flags of the metadata in hdr and returns the encoded metadata.
+func encodeMeta(hdr *entryHdr, codec Compression, meta entryMeta, buf *[maxMetaLen]byte) []byte {
+	hdr.flags &= flagDeleted | flagPinned
+	hdr.flags |= uint8(codec) << flagCodecShift
+	b := buf[:0]
+	if codec != CompressionNone {
+		b = b[:4]
+		binary.LittleEndian.PutUint32(b, meta.rawLen)
+	}
+	if meta.keyId != 0 {
+		hdr.flags |= flagEncrypted
+		b = append(b, meta.keyId)
+	}
+	if meta.staleAt != 0 {
+		if delta := hdr.expireAt - meta.staleAt; hdr.expireAt != 0 && delta >= 0 && delta <= 1<<32-1 {
+			hdr.flags |= flagStaleDelta
+			b = b[:len(b)+4]
+			binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(delta))
+		} else {
+			hdr.flags |= flagStaleAt
+			b = b[:len(b)+8]
+			binary.LittleEndian.PutUint64(b[len(b)-8:], uint64(meta.staleAt))
+		}
+	}
+	return b
+}
+
+// readMeta reads the metadata of the entry at offset.
+func (seg *segment) readMeta(hdr *entryHdr, offset int64) (meta entryMeta) {
+	n := hdr.metaLen()
+	if n == 0 {
+		return
+	}
+	var buf [maxMetaLen]byte
+	seg.rb.ReadAt(buf[:n], offset+ENTRY_HDR_SIZE+int64(hdr.keyLen)+int64(hdr.valLen))
+	b := buf[:n]
+	if hdr.codec() != CompressionNone {
+		meta.rawLen = binary.LittleEndian.Uint32(b)
+		b = b[4:]
+	}
+	if hdr.has(flagEncrypted) {
+		meta.keyId = b[0]
+		b = b[1:]
+	}
+	if hdr.has(flagStaleDelta) {
+		meta.staleAt = hdr.expireAt - int64(binary.LittleEndian.Uint32(b))
+	} else if hdr.has(flagStaleAt) {
+		meta.staleAt = int64(binary.LittleEndian.Uint64(b))
+	}
+	return
+}
+
+// keyID returns the id of the encryption key of the entry at offset, 0 if it is not encrypted.
+func (seg *segment) keyID(hdr *entryHdr, offset int64) uint8 {
+	if !hdr.has(flagEncrypted) {
+		return 0
+	}
+	return seg.readMeta(hdr, offset).keyId
+}
+
+// staleAt returns the time the entry at offset becomes stale, 0 if it has no soft TTL.
+func (seg *segment) staleAt(hdr *entryHdr, offset int64) int64 {
+	if !hdr.has(flagStaleDelta | flagStaleAt) {
+		return 0
+	}
+	return seg.readMeta(hdr, offset).staleAt
+}
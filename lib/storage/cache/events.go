@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// eventBufferSize is the number of events buffered for each subscriber.
+const eventBufferSize = 1024
+
+// EventType tells what happened to a key.
+type EventType int
+
+const (
+	// EventSet means the key was written, including counter updates.
+	EventSet EventType = iota + 1
+	// EventDelete means the key was deleted.
+	EventDelete
+	// EventExpire means the entry was removed after its expiration time.
+	EventExpire
+	// EventEvict means the entry was removed for another reason, given by Event.Reason.
+	EventEvict
+)
+
+func (typ EventType) String() string {
+	switch typ {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventEvict:
+		return "evict"
+	}
+	return "unknown"
+}
+
+// Event is a change of a key, Reason is set for all types but EventSet.
+// Key is shared by all subscribers and must not be modified.
+type Event struct {
+	Type   EventType
+	Key    []byte
+	Reason EvictReason
+}
+
+type subscriber struct {
+	ch     chan Event
+	filter func(key []byte) bool
+}
+
+// eventHub delivers the events of all segments to the subscribers.
+type eventHub struct {
+	mu      sync.RWMutex
+	subs    map[*subscriber]struct{}
+	active  int32 // number of subscribers, read by the segments without taking mu.
+	dropped int64
+}
+
+// Subscribe returns a channel receiving the changes of the keys that pass filter,
+// a nil filter selects all keys. The filter is called without any segment lock held.
+// Events are collected under the segment lock and delivered after it is released,
+// so a subscriber never blocks the cache. Each subscriber has a buffer of 1024 events,
+// when it is full new events for that subscriber are dropped and counted by DroppedEventCount.
+// Overwrites are reported as EventSet only. cancel stops the delivery and closes the channel.
+func (cache *Cache) Subscribe(filter func(key []byte) bool) (events <-chan Event, cancel func()) {
+	h := &cache.events
+	sub := &subscriber{ch: make(chan Event, eventBufferSize), filter: filter}
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[*subscriber]struct{})
+	}
+	h.subs[sub] = struct{}{}
+	atomic.StoreInt32(&h.active, int32(len(h.subs)))
+	h.mu.Unlock()
+	var once sync.Once
+	cancel = func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, sub)
+			atomic.StoreInt32(&h.active, int32(len(h.subs)))
+			h.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+	return sub.ch, cancel
+}
+
+// DroppedEventCount returns the number of events dropped because a subscriber was too slow.
+func (cache *Cache) DroppedEventCount() int64 {
+	return atomic.LoadInt64(&cache.events.dropped)
+}
+
+func (h *eventHub) enabled() bool {
+	return h != nil && atomic.LoadInt32(&h.active) > 0
+}
+
+func (h *eventHub) publish(events []Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		for _, e := range events {
+			if sub.filter != nil && !sub.filter(e.Key) {
+				continue
+			}
+			select {
+			case sub.ch <- e:
+			default:
+				atomic.AddInt64(&h.dropped, 1)
+			}
+		}
+	}
+}
+
+// notify records an event, it is published by Cache.unlockSegment.
+func (seg *segment) notify(typ EventType, key []byte, reason EvictReason) {
+	if !seg.events.enabled() {
+		return
+	}
+	seg.pending = append(seg.pending, Event{Type: typ, Key: append([]byte(nil), key...), Reason: reason})
+}
+
+// eventForReason returns the event type of an entry removed for reason.
+func eventForReason(reason EvictReason) EventType {
+	switch reason {
+	case EvictReasonDeleted:
+		return EventDelete
+	case EvictReasonExpired:
+		return EventExpire
+	}
+	return EventEvict
+}
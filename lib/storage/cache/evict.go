@@ -0,0 +1,123 @@
+package cache
+
+import "unsafe"
+
+// EvictReason tells why an entry left the cache.
+type EvictReason int
+
+const (
+	// EvictReasonExpired means the entry was removed after its expiration time.
+	EvictReasonExpired EvictReason = iota + 1
+	// EvictReasonCapacity means the entry was pushed out to make room for new entries.
+	EvictReasonCapacity
+	// EvictReasonDeleted means the entry was removed by Del.
+	EvictReasonDeleted
+	// EvictReasonOverwritten means the value was replaced by a new value for the same key.
+	EvictReasonOverwritten
+	// EvictReasonCleared means the entry was removed by Clear.
+	EvictReasonCleared
+	// EvictReasonInvalidated means the entry was removed after one of its tags was invalidated
+	// or the encryption key was changed, the value of such entries is reported as nil.
+	EvictReasonInvalidated
+)
+
+func (reason EvictReason) String() string {
+	switch reason {
+	case EvictReasonExpired:
+		return "expired"
+	case EvictReasonCapacity:
+		return "capacity"
+	case EvictReasonDeleted:
+		return "deleted"
+	case EvictReasonOverwritten:
+		return "overwritten"
+	case EvictReasonCleared:
+		return "cleared"
+	case EvictReasonInvalidated:
+		return "invalidated"
+	}
+	return "unknown"
+}
+
+// EvictCallback is called with a copy of the key and the value of an entry leaving the cache.
+type EvictCallback func(key, value []byte, reason EvictReason)
+
+type evictedEntry struct {
+	key    []byte
+	value  []byte
+	reason EvictReason
+}
+
+// OnEvict registers a callback that is called whenever an entry is expired, evicted,
+// deleted, overwritten or cleared. Passing nil removes the callback.
+// The callback is called after the segment lock is released, so it may use the cache,
+// but it runs on the goroutine that caused the eviction and should return quickly.
+func (cache *Cache) OnEvict(fn EvictCallback) {
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		cache.segments[i].onEvict = fn
+		cache.locks[i].Unlock()
+	}
+}
+
+// unlockSegment releases the segment lock and then reports the entries
+// evicted while it was held, publishes the events recorded and queues the
+// refreshes of the stale entries read.
+func (cache *Cache) unlockSegment(segID uint64) {
+	seg := &cache.segments[segID]
+	evicted, fn, stale, events, sampled := seg.evicted, seg.onEvict, seg.stale, seg.pending, seg.sampled
+	seg.evicted = nil
+	seg.stale = nil
+	seg.pending = nil
+	seg.sampled = nil
+	cache.locks[segID].Unlock()
+	if len(sampled) > 0 {
+		cache.hot.record(sampled)
+	}
+	if len(events) > 0 {
+		cache.events.publish(events)
+	}
+	for _, e := range evicted {
+		fn(e.key, e.value, e.reason)
+	}
+	for _, job := range stale {
+		cache.refresh.schedule(job)
+	}
+}
+
+// recordEvict keeps a copy of the entry at offset for the evict callback
+// and records the event for the subscribers.
+func (seg *segment) recordEvict(hdr *entryHdr, offset int64, reason EvictReason) {
+	notify := reason != EvictReasonOverwritten && seg.events.enabled()
+	if seg.onEvict == nil && !notify {
+		return
+	}
+	key := make([]byte, hdr.keyLen)
+	seg.rb.ReadAt(key, offset+ENTRY_HDR_SIZE)
+	if notify {
+		seg.notify(eventForReason(reason), key, reason)
+	}
+	if seg.onEvict != nil {
+		e := evictedEntry{
+			key:    key,
+			reason: reason,
+		}
+		e.value, _ = seg.readValue(hdr, offset, nil)
+		seg.evicted = append(seg.evicted, e)
+	}
+}
+
+// recordEvictAll records every live entry of the segment, used before it is cleared.
+func (seg *segment) recordEvictAll(reason EvictReason) {
+	if seg.onEvict == nil && !seg.events.enabled() {
+		return
+	}
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	for i := 0; i < 256; i++ {
+		for _, ptr := range seg.getSlot(uint8(i)) {
+			seg.rb.ReadAt(hdrBuf[:], ptr.offset)
+			seg.recordEvict(hdr, ptr.offset, reason)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultHotKeySampleRate is used when Options.HotKeySampleRate is 0.
+const defaultHotKeySampleRate = 16
+
+// HotKey is a frequently used key with estimated counts.
+// Counts are extrapolated from the sampled operations and may overestimate
+// a key by at most its Error.
+type HotKey struct {
+	Key   string
+	Count int64 // reads and writes of the key, or bytes written for the by-bytes ranking.
+	Error int64
+}
+
+// hotCounter is an entry of a space-saving summary.
+type hotCounter struct {
+	key   string
+	count int64
+	error int64
+	index int // position in the heap.
+}
+
+// spaceSaving keeps the approximate top keys by weight in a fixed number of counters.
+// When a new key arrives and all counters are used, it takes over the counter
+// with the smallest count, inheriting that count as its error.
+type spaceSaving struct {
+	capacity int
+	counters map[string]*hotCounter
+	heap     hotHeap // min-heap by count.
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, counters: make(map[string]*hotCounter, capacity)}
+}
+
+func (s *spaceSaving) add(key []byte, weight int64) {
+	if c, ok := s.counters[string(key)]; ok {
+		c.count += weight
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		c := &hotCounter{key: string(key), count: weight}
+		s.counters[c.key] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+	c := s.heap[0]
+	delete(s.counters, c.key)
+	c.key = string(key)
+	c.error = c.count
+	c.count += weight
+	s.counters[c.key] = c
+	heap.Fix(&s.heap, 0)
+}
+
+func (s *spaceSaving) top(k int) []HotKey {
+	keys := make([]HotKey, 0, len(s.heap))
+	for _, c := range s.heap {
+		keys = append(keys, HotKey{Key: c.key, Count: c.count, Error: c.error})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Count > keys[j].Count })
+	if k < len(keys) {
+		keys = keys[:k]
+	}
+	return keys
+}
+
+type hotHeap []*hotCounter
+
+func (h hotHeap) Len() int           { return len(h) }
+func (h hotHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hotHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotHeap) Push(x interface{}) {
+	c := x.(*hotCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *hotHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// hotKeys samples the operations of all segments into two space-saving summaries.
+type hotKeys struct {
+	rate    int
+	mu      sync.Mutex
+	access  *spaceSaving
+	written *spaceSaving
+}
+
+func newHotKeys(capacity, rate int) *hotKeys {
+	if rate <= 0 {
+		rate = defaultHotKeySampleRate
+	}
+	return &hotKeys{rate: rate, access: newSpaceSaving(capacity), written: newSpaceSaving(capacity)}
+}
+
+func (h *hotKeys) reset() {
+	h.mu.Lock()
+	h.access = newSpaceSaving(h.access.capacity)
+	h.written = newSpaceSaving(h.written.capacity)
+	h.mu.Unlock()
+}
+
+// sampleHot reports whether the current operation of the segment is sampled.
+func (seg *segment) sampleHot() bool {
+	if seg.hot == nil {
+		return false
+	}
+	return atomic.AddUint32(&seg.hotTick, 1)%uint32(seg.hot.rate) == 0
+}
+
+// hotSample is a sampled operation, written is the size of the value set.
+type hotSample struct {
+	key     []byte
+	written int
+}
+
+// recordHot samples a successful operation on key. The samples are added to the summaries
+// by Cache.unlockSegment, so the lock of the summaries is never taken under a segment lock.
+// The key is not copied, it stays valid until the operation returns.
+func (seg *segment) recordHot(key []byte, written int) {
+	if seg.sampleHot() {
+		seg.sampled = append(seg.sampled, hotSample{key: key, written: written})
+	}
+}
+
+// recordSharedHit samples a hit served under the read lock of the segment, after it was released.
+func (cache *Cache) recordSharedHit(segID uint64, key []byte) {
+	if cache.segments[segID].sampleHot() {
+		cache.hot.record([]hotSample{{key: key}})
+	}
+}
+
+// record adds sampled operations to the summaries.
+func (h *hotKeys) record(samples []hotSample) {
+	rate := int64(h.rate)
+	h.mu.Lock()
+	for _, s := range samples {
+		h.access.add(s.key, rate)
+		if s.written > 0 {
+			h.written.add(s.key, int64(s.written)*rate)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// HotKeys returns the k most used keys by reads and writes, and the k keys with the most
+// bytes written, if Options.HotKeyCapacity is set, with counts estimated from the sampled operations.
+func (cache *Cache) HotKeys(k int) (byAccess, byBytes []HotKey) {
+	h := cache.hot
+	if h == nil {
+		return nil, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.access.top(k), h.written.top(k)
+}
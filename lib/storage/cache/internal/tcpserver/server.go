@@ -0,0 +1,155 @@
+// Package tcpserver runs the TCP listeners and connections of the protocol servers of the cache.
+package tcpserver
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShutdownGrace is the time Shutdown gives a command to receive the rest of its data.
+const ShutdownGrace = time.Second
+
+// Conn is a connection served by a Server.
+type Conn struct {
+	net.Conn
+	server *Server
+	idle   bool // guarded by server.mu
+}
+
+// SetIdle marks the connection as waiting for the next command, or as running one.
+// It returns false if the server is shutting down and the connection should be closed.
+func (c *Conn) SetIdle(idle bool) bool {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.idle = idle
+	return !s.closing
+}
+
+// Server accepts connections and serves each of them with a handler in its own goroutine.
+// The connection is closed when the handler returns.
+type Server struct {
+	handler func(c *Conn)
+	closed  error
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*Conn]struct{}
+	closing   bool
+	wg        sync.WaitGroup
+
+	currConns  int64
+	totalConns int64
+}
+
+// New creates a server serving connections with handler, Serve returns closed after Shutdown.
+func New(handler func(c *Conn), closed error) *Server {
+	return &Server{
+		handler:   handler,
+		closed:    closed,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves the connections, see Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Shutdown is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return s.closed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return s.closed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		c := &Conn{Conn: nc, server: s}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			nc.Close()
+			return s.closed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		atomic.AddInt64(&s.currConns, 1)
+		atomic.AddInt64(&s.totalConns, 1)
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c *Conn) {
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		atomic.AddInt64(&s.currConns, -1)
+		s.wg.Done()
+	}()
+	s.handler(c)
+}
+
+// Shutdown stops accepting connections, lets the commands in progress finish,
+// closes all connections and waits for them to be closed. Commands whose data
+// is not received within ShutdownGrace are dropped.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		if c.idle {
+			// Wake up the read of the next command.
+			c.SetReadDeadline(time.Now())
+		} else {
+			// Do not wait for a client that stalls in the middle of a command.
+			c.SetReadDeadline(time.Now().Add(ShutdownGrace))
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// CurrConns returns the number of open connections.
+func (s *Server) CurrConns() int64 {
+	return atomic.LoadInt64(&s.currConns)
+}
+
+// TotalConns returns the number of connections accepted since the server was created.
+func (s *Server) TotalConns() int64 {
+	return atomic.LoadInt64(&s.totalConns)
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"unsafe"
 )
 
@@ -10,19 +11,25 @@ type Iterator struct {
 	segmentIdx int
 	slotIdx    int
 	entryIdx   int
+	filter     func(key []byte) bool
+	keyBuf     []byte
+	current    *entryPtr // the entry last returned by Next, used by Delete.
 }
 
 // Entry represents a key/value pair.
 type Entry struct {
-	Key   []byte
-	Value []byte
+	Key        []byte
+	Value      []byte
+	ExpireAt   int64  // Unix time in milliseconds, 0 means the entry never expires.
+	AccessTime uint32 // Unix time in seconds of the last access.
 }
 
 // Next returns the next entry for the iterator.
 // The order of the entries is not guaranteed.
 // If there is no more entries to return, nil will be returned.
 func (it *Iterator) Next() *Entry {
-	for it.segmentIdx < 256 {
+	it.current = nil
+	for it.segmentIdx < len(it.cache.segments) {
 		entry := it.nextForSegment(it.segmentIdx)
 		if entry != nil {
 			return entry
@@ -34,6 +41,32 @@ func (it *Iterator) Next() *Entry {
 	return nil
 }
 
+// Delete deletes the entry last returned by Next.
+// It returns false if there is no such entry or it has been deleted or overwritten since.
+// Deleting does not cause the iterator to skip or repeat other entries.
+func (it *Iterator) Delete() (affected bool) {
+	if it.current == nil {
+		return false
+	}
+	ptr := it.current
+	it.current = nil
+	segIdx := it.segmentIdx
+	it.cache.locks[segIdx].Lock()
+	seg := &it.cache.segments[segIdx]
+	slotId := uint8(it.slotIdx)
+	slot := seg.getSlot(slotId)
+	idx, match := seg.lookupByOff(slot, ptr.hash16, ptr.offset)
+	if match {
+		seg.delEntry(slotId, slot, idx)
+		if idx < it.entryIdx {
+			it.entryIdx--
+		}
+		affected = true
+	}
+	it.cache.unlockSegment(uint64(segIdx))
+	return
+}
+
 func (it *Iterator) nextForSegment(segIdx int) *Entry {
 	it.cache.locks[segIdx].Lock()
 	defer it.cache.locks[segIdx].Unlock()
@@ -55,18 +88,35 @@ func (it *Iterator) nextForSlot(seg *segment, slotId int) *Entry {
 	for it.entryIdx < len(slot) {
 		ptr := slot[it.entryIdx]
 		it.entryIdx++
-		now := seg.timer.Now()
+		nowMs := nowMilli(seg.timer)
 		var hdrBuf [ENTRY_HDR_SIZE]byte
 		seg.rb.ReadAt(hdrBuf[:], ptr.offset)
 		hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
-		if hdr.expireAt == 0 || hdr.expireAt > now {
-			entry := new(Entry)
-			entry.Key = make([]byte, hdr.keyLen)
-			entry.Value = make([]byte, hdr.valLen)
-			seg.rb.ReadAt(entry.Key, ptr.offset+ENTRY_HDR_SIZE)
-			seg.rb.ReadAt(entry.Value, ptr.offset+ENTRY_HDR_SIZE+int64(hdr.keyLen))
-			return entry
+		if hdr.expireAt != 0 && hdr.expireAt <= nowMs || seg.invalidated(hdr, ptr.offset) {
+			continue
 		}
+		if it.filter != nil {
+			if cap(it.keyBuf) < int(hdr.keyLen) {
+				it.keyBuf = make([]byte, hdr.keyLen)
+			}
+			it.keyBuf = it.keyBuf[:hdr.keyLen]
+			seg.rb.ReadAt(it.keyBuf, ptr.offset+ENTRY_HDR_SIZE)
+			if !it.filter(it.keyBuf) {
+				continue
+			}
+		}
+		value, err := seg.readValue(hdr, ptr.offset, nil)
+		if err != nil {
+			continue
+		}
+		entry := new(Entry)
+		entry.Key = make([]byte, hdr.keyLen)
+		entry.ExpireAt = hdr.expireAt
+		entry.AccessTime = hdr.accessTime
+		entry.Value = value
+		seg.rb.ReadAt(entry.Key, ptr.offset+ENTRY_HDR_SIZE)
+		it.current = &ptr
+		return entry
 	}
 	return nil
 }
@@ -77,3 +127,81 @@ func (cache *Cache) NewIterator() *Iterator {
 		cache: cache,
 	}
 }
+
+// NewIteratorWithFilter creates a new iterator that only returns the entries whose key passes filter.
+// The filter is called with a segment lock held, it must not use the cache or retain the key.
+func (cache *Cache) NewIteratorWithFilter(filter func(key []byte) bool) *Iterator {
+	return &Iterator{
+		cache:  cache,
+		filter: filter,
+	}
+}
+
+// ScanPrefix calls fn for every entry whose key starts with prefix until fn returns false.
+// fn is called without holding any lock and may modify the cache.
+func (cache *Cache) ScanPrefix(prefix []byte, fn func(entry *Entry) bool) {
+	it := cache.NewIteratorWithFilter(func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	})
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		if !fn(entry) {
+			return
+		}
+	}
+}
+
+// DelPrefix deletes all entries whose key starts with prefix and returns the number of deleted entries.
+func (cache *Cache) DelPrefix(prefix []byte) (deleted int) {
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		deleted += cache.segments[i].delPrefix(prefix)
+		cache.unlockSegment(uint64(i))
+	}
+	return
+}
+
+// Scan returns the keys of whole slots starting at cursor until at least count keys
+// passing filter are collected, and the cursor to continue with, 0 when the scan is done.
+// Start with cursor 0. Keys present during the whole scan are returned at least once,
+// keys written or deleted meanwhile may or may not be.
+// filter is called without holding any lock.
+func (cache *Cache) Scan(cursor uint64, count int, filter func(key []byte) bool) (keys [][]byte, next uint64) {
+	total := uint64(len(cache.segments)) * 256
+	for ; cursor < total && len(keys) < count; cursor++ {
+		segIdx := int(cursor / 256)
+		n := len(keys)
+		cache.locks[segIdx].Lock()
+		keys = cache.segments[segIdx].slotKeys(uint8(cursor%256), keys)
+		cache.locks[segIdx].Unlock()
+		if filter != nil {
+			kept := keys[:n]
+			for _, key := range keys[n:] {
+				if filter(key) {
+					kept = append(kept, key)
+				}
+			}
+			keys = kept
+		}
+	}
+	if cursor >= total {
+		return keys, 0
+	}
+	return keys, cursor
+}
+
+// slotKeys appends the keys of the live entries in the slot.
+func (seg *segment) slotKeys(slotId uint8, keys [][]byte) [][]byte {
+	nowMs := nowMilli(seg.timer)
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	for _, ptr := range seg.getSlot(slotId) {
+		seg.rb.ReadAt(hdrBuf[:], ptr.offset)
+		if hdr.expireAt != 0 && hdr.expireAt <= nowMs || seg.invalidated(hdr, ptr.offset) {
+			continue
+		}
+		key := make([]byte, hdr.keyLen)
+		seg.rb.ReadAt(key, ptr.offset+ENTRY_HDR_SIZE)
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	// defaultJanitorBudget is the time a sweep may take when Options.JanitorBudget is 0.
+	defaultJanitorBudget = time.Millisecond
+	// janitorSlotsPerLock is the number of slots swept under one segment lock.
+	janitorSlotsPerLock = 16
+)
+
+// janitor sweeps expired entries in the background, a slot range at a time.
+type janitor struct {
+	interval time.Duration
+	budget   time.Duration
+	cursor   uint64 // next slot to sweep, over all segments.
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (cache *Cache) startJanitor(interval, budget time.Duration) {
+	if budget <= 0 {
+		budget = defaultJanitorBudget
+	}
+	j := &janitor{
+		interval: interval,
+		budget:   budget,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	cache.janitor = j
+	go cache.runJanitor(j)
+}
+
+func (cache *Cache) runJanitor(j *janitor) {
+	defer close(j.done)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			cache.sweep(j)
+		}
+	}
+}
+
+// sweep removes expired entries from the slots after the cursor until the budget is used
+// or all slots were visited once, the next sweep continues where this one stopped.
+func (cache *Cache) sweep(j *janitor) {
+	start := time.Now()
+	total := uint64(len(cache.segments)) * 256
+	for visited := uint64(0); visited < total; visited += janitorSlotsPerLock {
+		segID := j.cursor / 256
+		cache.locks[segID].Lock()
+		seg := &cache.segments[segID]
+		nowMs := nowMilli(seg.timer)
+		for i := uint64(0); i < janitorSlotsPerLock; i++ {
+			seg.sweepSlot(uint8((j.cursor+i)%256), nowMs)
+		}
+		cache.unlockSegment(segID)
+		j.cursor = (j.cursor + janitorSlotsPerLock) % total
+		if time.Since(start) >= j.budget {
+			return
+		}
+	}
+}
+
+// sweepSlot removes the expired entries of a slot.
+func (seg *segment) sweepSlot(slotId uint8, nowMs int64) {
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	slot := seg.getSlot(slotId)
+	for idx := 0; idx < len(slot); {
+		seg.rb.ReadAt(hdrBuf[:], slot[idx].offset)
+		if hdr.expireAt == 0 || hdr.expireAt > nowMs {
+			idx++
+			continue
+		}
+		seg.recordEvict(hdr, slot[idx].offset, EvictReasonExpired)
+		seg.delEntryPtr(slotId, slot, idx)
+		atomic.AddInt64(&seg.totalExpired, 1)
+		slot = slot[:len(slot)-1]
+	}
+}
+
+// stopJanitor stops the janitor and waits for the sweep in progress.
+func (cache *Cache) stopJanitor() {
+	j := cache.janitor
+	if j == nil {
+		return
+	}
+	j.once.Do(func() {
+		close(j.stop)
+	})
+	<-j.done
+}
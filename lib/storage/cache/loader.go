@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxNegativeEntries bounds the number of loader errors kept for negative caching.
+const maxNegativeEntries = 4096
+
+var ErrLoaderPanic = errors.New("The loader panicked")
+
+// loadCall is an in-flight or completed loader call.
+type loadCall struct {
+	wg    sync.WaitGroup
+	key   []byte
+	value []byte
+	err   error
+}
+
+// negativeEntry is a cached loader error.
+type negativeEntry struct {
+	key      []byte
+	err      error
+	expireAt int64 // Unix time in milliseconds.
+}
+
+// loadGroup collapses concurrent loads of the same key into a single loader call.
+// Calls are keyed by the hash of the key, the key itself is compared to rule out collisions.
+type loadGroup struct {
+	mu          sync.Mutex
+	calls       map[uint64]*loadCall
+	negatives   map[uint64]*negativeEntry
+	negativeTTL time.Duration
+}
+
+// SetNegativeTTL enables negative caching for GetOrLoad.
+// An error returned by a loader is remembered for expireSeconds and returned to
+// the following GetOrLoad calls for the same key without calling the loader again.
+// A value <= 0 disables negative caching and drops the remembered errors.
+func (cache *Cache) SetNegativeTTL(expireSeconds int) {
+	cache.SetNegativeTTLDuration(secondsToTTL(expireSeconds))
+}
+
+// SetNegativeTTLDuration is SetNegativeTTL with a millisecond precision time to live.
+func (cache *Cache) SetNegativeTTLDuration(ttl time.Duration) {
+	g := &cache.loads
+	g.mu.Lock()
+	if ttl >= time.Millisecond {
+		g.negativeTTL = ttl
+	} else {
+		g.negativeTTL = 0
+		g.negatives = nil
+	}
+	g.mu.Unlock()
+}
+
+// GetOrLoad returns the value for the key, calling loader to produce and cache it on a miss.
+// Concurrent misses for the same key share a single loader call.
+// The loaded value is stored with expireSeconds, loader errors are returned as is
+// and are not stored unless negative caching is enabled by SetNegativeTTL.
+func (cache *Cache) GetOrLoad(key []byte, expireSeconds int, loader func() ([]byte, error)) (value []byte, err error) {
+	return cache.GetOrLoadWithTTL(key, secondsToTTL(expireSeconds), loader)
+}
+
+// GetOrLoadWithTTL is GetOrLoad storing the loaded value with a millisecond precision time to live.
+// A ttl <= 0 means the value never expires.
+func (cache *Cache) GetOrLoadWithTTL(key []byte, ttl time.Duration, loader func() ([]byte, error)) (value []byte, err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	cache.locks[segID].Lock()
+	value, _, err = cache.segments[segID].get(key, nil, hashVal, false)
+	cache.unlockSegment(segID)
+	if err == nil {
+		return
+	}
+
+	g := &cache.loads
+	g.mu.Lock()
+	if n, ok := g.negatives[hashVal]; ok && bytes.Equal(n.key, key) {
+		if n.expireAt > nowMilli(cache.timer) {
+			g.mu.Unlock()
+			return nil, n.err
+		}
+		delete(g.negatives, hashVal)
+	}
+	if c, ok := g.calls[hashVal]; ok && bytes.Equal(c.key, key) {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+	// Another loader may have finished between the first lookup and taking g.mu.
+	var expireAt int64
+	cache.locks[segID].Lock()
+	value, expireAt, err = cache.segments[segID].get(key, nil, hashVal, true)
+	cache.unlockSegment(segID)
+	if err == nil && (expireAt == 0 || expireAt > nowMilli(cache.timer)) {
+		g.mu.Unlock()
+		return
+	}
+	c := &loadCall{key: key, err: ErrLoaderPanic}
+	c.wg.Add(1)
+	shared := false
+	if _, ok := g.calls[hashVal]; !ok {
+		if g.calls == nil {
+			g.calls = make(map[uint64]*loadCall)
+		}
+		g.calls[hashVal] = c
+		shared = true
+	}
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		if shared {
+			delete(g.calls, hashVal)
+		}
+		if c.err != nil && g.negativeTTL > 0 {
+			g.addNegative(hashVal, key, c.err, nowMilli(cache.timer)+int64(g.negativeTTL/time.Millisecond))
+		}
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.value, c.err = loader()
+	if c.err == nil {
+		// The value is returned even if it can not be cached, e.g. ErrLargeEntry.
+		cache.SetWithTTL(key, c.value, ttl)
+	}
+	return c.value, c.err
+}
+
+func (g *loadGroup) addNegative(hashVal uint64, key []byte, err error, expireAt int64) {
+	if g.negatives == nil {
+		g.negatives = make(map[uint64]*negativeEntry)
+	}
+	if len(g.negatives) >= maxNegativeEntries {
+		// Map iteration order is random, so this drops arbitrary entries.
+		for h := range g.negatives {
+			delete(g.negatives, h)
+			if len(g.negatives) < maxNegativeEntries/2 {
+				break
+			}
+		}
+	}
+	g.negatives[hashVal] = &negativeEntry{
+		key:      append([]byte(nil), key...),
+		err:      err,
+		expireAt: expireAt,
+	}
+}
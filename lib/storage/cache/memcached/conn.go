@@ -0,0 +1,423 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"github.com/godofcc/go-common/lib/storage/cache/internal/tcpserver"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxLineLen = 2048
+	maxKeyLen  = 250
+	// maxRelativeExptime is the largest exptime taken as seconds from now,
+	// larger ones are Unix times as in memcached.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+	// flagsLen is the size of the client flags stored in front of every value.
+	flagsLen = 4
+	version  = "1.6.0-go-common"
+)
+
+var (
+	crlf = []byte("\r\n")
+	end  = []byte("END\r\n")
+)
+
+type conn struct {
+	server *Server
+	nc     *tcpserver.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+}
+
+func (c *conn) serve() {
+	for {
+		if !c.nc.SetIdle(true) {
+			return
+		}
+		line, err := c.r.ReadSlice('\n')
+		if !c.nc.SetIdle(false) && len(line) == 0 {
+			return
+		}
+		if err == bufio.ErrBufferFull || len(line) > maxLineLen {
+			c.w.WriteString("CLIENT_ERROR line too long\r\n")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			c.w.WriteString("ERROR\r\n")
+		} else if quit := c.dispatch(fields); quit {
+			c.w.Flush()
+			return
+		}
+		if c.r.Buffered() == 0 {
+			if c.w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// dispatch runs one command, it returns true if the connection should be closed.
+func (c *conn) dispatch(fields [][]byte) (quit bool) {
+	args := fields[1:]
+	switch string(fields[0]) {
+	case "get":
+		c.get(args, false)
+	case "gets":
+		c.get(args, true)
+	case "set", "add", "replace", "cas":
+		return c.store(string(fields[0]), args)
+	case "delete":
+		c.delete(args)
+	case "touch":
+		c.touch(args)
+	case "incr":
+		c.incr(args, true)
+	case "decr":
+		c.incr(args, false)
+	case "stats":
+		c.stats(args)
+	case "flush_all":
+		c.flushAll(args)
+	case "version":
+		c.w.WriteString("VERSION " + version + "\r\n")
+	case "quit":
+		return true
+	default:
+		c.w.WriteString("ERROR\r\n")
+	}
+	return false
+}
+
+func validKey(key []byte) bool {
+	if len(key) == 0 || len(key) > maxKeyLen {
+		return false
+	}
+	for _, b := range key {
+		if b <= ' ' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// noreply removes a trailing noreply argument.
+func noreply(args [][]byte) ([][]byte, bool) {
+	if n := len(args); n > 0 && string(args[n-1]) == "noreply" {
+		return args[:n-1], true
+	}
+	return args, false
+}
+
+// reply writes a response unless the client asked for none.
+func (c *conn) reply(quiet bool, s string) {
+	if !quiet {
+		c.w.WriteString(s)
+	}
+}
+
+// ttl converts a memcached exptime, expired is true for an exptime in the past.
+func ttl(exptime int64) (d time.Duration, expired bool) {
+	if exptime < 0 {
+		return 0, true
+	}
+	if exptime > maxRelativeExptime {
+		exptime -= time.Now().Unix()
+		if exptime <= 0 {
+			return 0, true
+		}
+	}
+	return time.Duration(exptime) * time.Second, false
+}
+
+func (c *conn) get(keys [][]byte, withCas bool) {
+	if len(keys) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return
+	}
+	for _, key := range keys {
+		value, ver, err := c.server.cache.GetWithVersion(key)
+		if err != nil || len(value) < flagsLen {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(value)
+		data := value[flagsLen:]
+		if withCas {
+			fmt.Fprintf(c.w, "VALUE %s %d %d %d\r\n", key, flags, len(data), ver)
+		} else {
+			fmt.Fprintf(c.w, "VALUE %s %d %d\r\n", key, flags, len(data))
+		}
+		c.w.Write(data)
+		c.w.Write(crlf)
+	}
+	c.w.Write(end)
+}
+
+func (c *conn) store(cmd string, args [][]byte) (quit bool) {
+	args, quiet := noreply(args)
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) != want || !validKey(args[0]) {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	flags, err1 := strconv.ParseUint(string(args[1]), 10, 32)
+	exptime, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	size, err3 := strconv.Atoi(string(args[3]))
+	var casUnique uint64
+	var err4 error
+	if cmd == "cas" {
+		casUnique, err4 = strconv.ParseUint(string(args[4]), 10, 32)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	maxSize := c.server.cache.MaxEntrySize()
+	if size > maxSize {
+		// The data block is not read, it could be of any size.
+		c.w.WriteString("CLIENT_ERROR object too large for cache\r\n")
+		return true
+	}
+	if flagsLen+len(args[0])+size > maxSize {
+		// Skip the data block, the connection stays usable.
+		if _, err := io.CopyN(ioutil.Discard, c.r, int64(size)+2); err != nil {
+			return true
+		}
+		c.reply(quiet, "SERVER_ERROR object too large for cache\r\n")
+		return false
+	}
+	value := make([]byte, flagsLen+size+2)
+	if _, err := io.ReadFull(c.r, value[flagsLen:]); err != nil {
+		return true
+	}
+	if !bytes.Equal(value[flagsLen+size:], crlf) {
+		c.w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+	value = value[:flagsLen+size]
+	binary.BigEndian.PutUint32(value, uint32(flags))
+	atomic.AddInt64(&c.server.cmdSet, 1)
+
+	key := args[0]
+	d, expired := ttl(exptime)
+	cc := c.server.cache
+	var stored bool
+	var err error
+	switch cmd {
+	case "set":
+		if expired {
+			cc.Del(key)
+			stored = true
+		} else {
+			err = cc.SetWithTTL(key, value, d)
+			stored = err == nil
+		}
+	case "add":
+		_, err = cc.CompareAndSet(key, value, 0, d)
+		stored = err == nil
+	case "replace":
+		stored, err = c.replace(key, value, d)
+	case "cas":
+		var ver uint32
+		if _, ver, err = cc.GetWithVersion(key); err == cache.ErrNotFound {
+			c.reply(quiet, "NOT_FOUND\r\n")
+			return false
+		}
+		if ver != uint32(casUnique) {
+			c.reply(quiet, "EXISTS\r\n")
+			return false
+		}
+		if _, err = cc.CompareAndSet(key, value, ver, d); err == cache.ErrVersionMismatch {
+			c.reply(quiet, "EXISTS\r\n")
+			return false
+		}
+		stored = err == nil
+	}
+	if expired && stored && cmd != "set" {
+		cc.Del(key)
+	}
+	switch {
+	case err == cache.ErrLargeEntry || err == cache.ErrLargeKey:
+		c.reply(quiet, "SERVER_ERROR object too large for cache\r\n")
+	case stored:
+		c.reply(quiet, "STORED\r\n")
+	default:
+		c.reply(quiet, "NOT_STORED\r\n")
+	}
+	return false
+}
+
+// replace sets the value only if the key exists.
+func (c *conn) replace(key, value []byte, d time.Duration) (stored bool, err error) {
+	for {
+		_, ver, err := c.server.cache.GetWithVersion(key)
+		if err != nil {
+			return false, nil
+		}
+		_, err = c.server.cache.CompareAndSet(key, value, ver, d)
+		if err != cache.ErrVersionMismatch {
+			return err == nil, err
+		}
+	}
+}
+
+func (c *conn) delete(args [][]byte) {
+	args, quiet := noreply(args)
+	if len(args) != 1 {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if c.server.cache.Del(args[0]) {
+		c.reply(quiet, "DELETED\r\n")
+	} else {
+		c.reply(quiet, "NOT_FOUND\r\n")
+	}
+}
+
+func (c *conn) touch(args [][]byte) {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	atomic.AddInt64(&c.server.cmdTouch, 1)
+	d, expired := ttl(exptime)
+	if expired {
+		err = cache.ErrNotFound
+		if c.server.cache.Del(args[0]) {
+			err = nil
+		}
+	} else {
+		err = c.server.cache.TouchWithTTL(args[0], d)
+	}
+	if err == nil {
+		c.reply(quiet, "TOUCHED\r\n")
+	} else {
+		c.reply(quiet, "NOT_FOUND\r\n")
+	}
+}
+
+// incr updates a decimal value as memcached does: incr wraps around at 2^64, decr stops at 0.
+func (c *conn) incr(args [][]byte, up bool) {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	delta, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+	key := args[0]
+	cc := c.server.cache
+	for {
+		value, ver, err := cc.GetWithVersion(key)
+		if err != nil || len(value) < flagsLen {
+			c.reply(quiet, "NOT_FOUND\r\n")
+			return
+		}
+		n, err := strconv.ParseUint(string(bytes.TrimSpace(value[flagsLen:])), 10, 64)
+		if err != nil {
+			c.w.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+			return
+		}
+		if up {
+			n += delta
+		} else if n < delta {
+			n = 0
+		} else {
+			n -= delta
+		}
+		d, err := cc.TTLDuration(key)
+		if err != nil {
+			c.reply(quiet, "NOT_FOUND\r\n")
+			return
+		}
+		newValue := strconv.AppendUint(append([]byte(nil), value[:flagsLen]...), n, 10)
+		if _, err = cc.CompareAndSet(key, newValue, ver, d); err == cache.ErrVersionMismatch {
+			continue
+		}
+		if err != nil {
+			c.w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+			return
+		}
+		c.reply(quiet, strconv.FormatUint(n, 10)+"\r\n")
+		return
+	}
+}
+
+func (c *conn) stats(args [][]byte) {
+	if len(args) > 0 {
+		c.w.Write(end)
+		return
+	}
+	s := c.server
+	cc := s.cache
+	now := time.Now()
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(c.w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.started)/time.Second))
+	stat("time", now.Unix())
+	stat("version", version)
+	stat("curr_connections", s.tcp.CurrConns())
+	stat("total_connections", s.tcp.TotalConns())
+	stat("cmd_get", cc.LookupCount())
+	stat("cmd_set", atomic.LoadInt64(&s.cmdSet))
+	stat("cmd_touch", atomic.LoadInt64(&s.cmdTouch))
+	stat("get_hits", cc.HitCount())
+	stat("get_misses", cc.MissCount())
+	stat("touch_hits", cc.TouchedCount())
+	stat("curr_items", cc.EntryCount())
+	stat("evictions", cc.EvacuateCount())
+	stat("expired_unfetched", cc.ExpiredCount())
+	stat("overwrites", cc.OverwriteCount())
+	stat("average_access_time", cc.AverageAccessTime())
+	stat("hit_rate", cc.HitRate())
+	c.w.Write(end)
+}
+
+func (c *conn) flushAll(args [][]byte) {
+	args, quiet := noreply(args)
+	if len(args) > 1 {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	var delay int64
+	if len(args) == 1 {
+		var err error
+		if delay, err = strconv.ParseInt(string(args[0]), 10, 64); err != nil || delay < 0 {
+			c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+	if delay == 0 {
+		c.server.cache.Clear()
+	} else {
+		time.AfterFunc(time.Duration(delay)*time.Second, c.server.cache.Clear)
+	}
+	c.reply(quiet, "OK\r\n")
+}
@@ -0,0 +1,60 @@
+// Package memcached serves a cache.Cache over the memcached ASCII protocol.
+package memcached
+
+import (
+	"bufio"
+	"errors"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"github.com/godofcc/go-common/lib/storage/cache/internal/tcpserver"
+	"net"
+	"time"
+)
+
+var ErrServerClosed = errors.New("The memcached server is closed")
+
+// Server serves a cache to memcached clients.
+// Values are stored in the cache with the 4 byte client flags in front of the data,
+// so the cache should not be shared with code that reads or writes the same keys directly.
+type Server struct {
+	cache   *cache.Cache
+	started time.Time
+	tcp     *tcpserver.Server
+
+	cmdSet   int64
+	cmdTouch int64
+}
+
+// NewServer creates a server for the cache.
+func NewServer(c *cache.Cache) *Server {
+	s := &Server{cache: c, started: time.Now()}
+	s.tcp = tcpserver.New(s.serveConn, ErrServerClosed)
+	return s
+}
+
+func (s *Server) serveConn(nc *tcpserver.Conn) {
+	c := &conn{server: s, nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	c.serve()
+}
+
+// ListenAndServe listens on the TCP address addr and serves the connections, see Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	return s.tcp.ListenAndServe(addr)
+}
+
+// Serve accepts connections on l until Shutdown is called, it then returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	return s.tcp.Serve(l)
+}
+
+// Shutdown stops accepting connections, lets the commands in progress finish,
+// closes all connections and waits for them to be closed. Commands whose data block
+// is not received within a second are dropped.
+func (s *Server) Shutdown() error {
+	return s.tcp.Shutdown()
+}
+
+// OnShutdown implements shutdown.ShutdownCallback, register the server with
+// GracefulShutdown.AddShutdownCallback to shut it down with the process.
+func (s *Server) OnShutdown(string) error {
+	return s.Shutdown()
+}
@@ -0,0 +1,120 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"github.com/godofcc/go-common/lib/storage/cache/internal/tcpserver"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(cache.NewCache(512 * 1024))
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	roundTrip := func(req string, lines int) string {
+		if _, err := nc.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		var resp []string
+		for i := 0; i < lines; i++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%q: %v", req, err)
+			}
+			resp = append(resp, strings.TrimRight(line, "\r\n"))
+		}
+		return strings.Join(resp, "|")
+	}
+	expect := func(req string, want string) {
+		t.Helper()
+		if got := roundTrip(req, strings.Count(want, "|")+1); got != want {
+			t.Fatalf("%q: got %q, want %q", req, got, want)
+		}
+	}
+
+	expect("set a 5 0 5\r\nhello\r\n", "STORED")
+	expect("get a b\r\n", "VALUE a 5 5|hello|END")
+	expect("add a 0 0 1\r\nx\r\n", "NOT_STORED")
+	expect("add b 0 0 1\r\nx\r\n", "STORED")
+	expect("replace c 0 0 1\r\nx\r\n", "NOT_STORED")
+	expect("replace b 0 0 2\r\n10\r\n", "STORED")
+	expect("incr b 5\r\n", "15")
+	expect("decr b 20\r\n", "0")
+	expect("incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	expect("incr c 1\r\n", "NOT_FOUND")
+
+	line := roundTrip("gets a\r\n", 3)
+	fields := strings.Fields(strings.Split(line, "|")[0])
+	if len(fields) != 5 {
+		t.Fatalf("gets: %q", line)
+	}
+	expect("cas a 0 0 3 "+fields[4]+"\r\nbye\r\n", "STORED")
+	expect("cas a 0 0 3 "+fields[4]+"\r\nbye\r\n", "EXISTS")
+	expect("touch a 100\r\n", "TOUCHED")
+	expect("touch c 100\r\n", "NOT_FOUND")
+	expect("delete a\r\n", "DELETED")
+	expect("delete a\r\n", "NOT_FOUND")
+	expect("set d 0 0 1 noreply\r\nx\r\nget d\r\n", "VALUE d 0 1|x|END")
+	// The data fits, but not with the flags and the key.
+	size := s.cache.MaxEntrySize()
+	expect(fmt.Sprintf("set big 0 0 %d\r\n%s\r\nget big\r\n", size, strings.Repeat("x", size)), "SERVER_ERROR object too large for cache|END")
+
+	stats := roundTrip("stats\r\n", 19)
+	if !strings.Contains(stats, "STAT curr_items 2") || !strings.HasSuffix(stats, "END") {
+		t.Fatalf("stats: %q", stats)
+	}
+	expect("flush_all\r\n", "OK")
+	expect("get b d\r\n", "END")
+
+	// A size that can not be stored closes the connection without reading the data.
+	tooLarge, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tooLarge.Close()
+	tooLarge.Write([]byte("set k 0 0 9223372036854775807\r\n"))
+	tr := bufio.NewReader(tooLarge)
+	if line, err := tr.ReadString('\n'); err != nil || line != "CLIENT_ERROR object too large for cache\r\n" {
+		t.Fatalf("set too large: %q %v", line, err)
+	}
+	if _, err := tr.ReadString('\n'); err == nil {
+		t.Fatal("the connection is still open after a too large set")
+	}
+
+	// A client stalling in the middle of a data block does not block the shutdown.
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stalled.Write([]byte("set k 0 0 10\r\nabc"))
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := s.OnShutdown("test"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 2*tcpserver.ShutdownGrace {
+		t.Fatalf("shutdown took %v", time.Since(start))
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("the connection is still open after the shutdown")
+	}
+}
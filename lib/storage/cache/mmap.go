@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"unsafe"
+)
+
+const (
+	mmapMagic    = 0x50414d43 // "CMAP"
+	mmapPageSize = 4096
+)
+
+var ErrMmapUnsupported = errors.New("Memory mapped caches are not supported on this platform")
+var ErrMmapLayout = errors.New("The cache file was created with a different layout")
+var ErrResizeMapped = errors.New("Memory mapped caches can not be resized")
+
+// mmapHeader is stored at the beginning of the cache file.
+type mmapHeader struct {
+	Magic        uint32
+	Version      uint32
+	SegmentCount uint32
+	EntryHdrSize uint32
+	SegmentSize  int64
+	Clean        uint32 // 1 if the segment headers were written by Close.
+	_            uint32
+}
+
+// mappedFile is the file behind a cache created by NewCacheMmap.
+// The file holds the mmapHeader in the first page, followed by a segmentHeader
+// for every segment and the page aligned ring buffers of all segments.
+type mappedFile struct {
+	file     *os.File
+	data     []byte
+	metaSize int
+}
+
+// NewCacheMmap creates a cache whose ring buffers live in the memory mapped file at path,
+// outside of the Go heap. If the file was written by a cache of the same size that was
+// closed with Close, its entries are recovered.
+func NewCacheMmap(path string, size int) (cache *Cache, err error) {
+	return NewCacheMmapWithOptions(path, Options{Size: size})
+}
+
+// NewCacheMmapWithOptions is like NewCacheMmap with the cache configured by opts.
+// Reopening a file with a different Size or Segments fails with ErrMmapLayout.
+func NewCacheMmapWithOptions(path string, opts Options) (cache *Cache, err error) {
+	segments, segSize := opts.normalize()
+	metaSize := binary.Size(segmentHeader{})
+	dataOff := (mmapPageSize + segments*metaSize + mmapPageSize - 1) / mmapPageSize * mmapPageSize
+	fileSize := dataOff + segments*segSize
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	fresh := st.Size() == 0
+	if fresh {
+		err = f.Truncate(int64(fileSize))
+	} else if st.Size() != int64(fileSize) {
+		err = ErrMmapLayout
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	data, err := mmapFile(f, fileSize)
+	if err != nil {
+		f.Close()
+		return
+	}
+	m := &mappedFile{file: f, data: data, metaSize: metaSize}
+	hdr := (*mmapHeader)(unsafe.Pointer(&data[0]))
+	if !fresh && (hdr.Magic != mmapMagic || hdr.Version != snapshotVersion || hdr.EntryHdrSize != ENTRY_HDR_SIZE ||
+		hdr.SegmentCount != uint32(segments) || hdr.SegmentSize != int64(segSize)) {
+		m.close()
+		return nil, ErrMmapLayout
+	}
+
+	cache = newCache(opts, segments, func(i int) []byte {
+		off := dataOff + i*segSize
+		return data[off : off+segSize : off+segSize]
+	})
+	cache.mapped = m
+	if !fresh && hdr.Clean == 1 {
+		for i := range cache.segments {
+			if err = cache.segments[i].restore(m.meta(i)); err != nil {
+				// The file is damaged, start with an empty cache.
+				for j := range cache.segments {
+					cache.segments[j].clear()
+				}
+				err = nil
+				break
+			}
+		}
+	}
+	// The file stays marked dirty until Close writes the segment headers back.
+	*hdr = mmapHeader{
+		Magic:        mmapMagic,
+		Version:      snapshotVersion,
+		SegmentCount: uint32(segments),
+		EntryHdrSize: ENTRY_HDR_SIZE,
+		SegmentSize:  int64(segSize),
+	}
+	if err = msyncFile(data[:mmapPageSize]); err != nil {
+		m.close()
+		return nil, err
+	}
+	if opts.JanitorInterval > 0 {
+		cache.startJanitor(opts.JanitorInterval, opts.JanitorBudget)
+	}
+	return
+}
+
+// closeMapped writes the segment headers, flushes the cache to its file and unmaps it.
+func (cache *Cache) closeMapped() (err error) {
+	m := cache.mapped
+	var buf bytes.Buffer
+	for i := range cache.segments {
+		buf.Reset()
+		cache.locks[i].Lock()
+		cache.segments[i].dropInvalidated()
+		hdr := cache.segments[i].header()
+		cache.unlockSegment(uint64(i))
+		binary.Write(&buf, binary.LittleEndian, &hdr)
+		copy(m.meta(i), buf.Bytes())
+	}
+	if err = msyncFile(m.data); err != nil {
+		m.close()
+		return
+	}
+	(*mmapHeader)(unsafe.Pointer(&m.data[0])).Clean = 1
+	if err = msyncFile(m.data[:mmapPageSize]); err != nil {
+		m.close()
+		return
+	}
+	return m.close()
+}
+
+func (m *mappedFile) meta(i int) []byte {
+	off := mmapPageSize + i*m.metaSize
+	return m.data[off : off+m.metaSize]
+}
+
+func (m *mappedFile) close() (err error) {
+	err = munmapFile(m.data)
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// restore recovers the segment from the header written by Close and the data
+// already in its ring buffer, the slot index is rebuilt by scanning the entries.
+func (seg *segment) restore(meta []byte) (err error) {
+	var hdr segmentHeader
+	if err = binary.Read(bytes.NewReader(meta), binary.LittleEndian, &hdr); err != nil {
+		return ErrInvalidSnapshot
+	}
+	if hdr.BufSize != seg.rb.Size() || hdr.End < hdr.Begin || hdr.End-hdr.Begin > hdr.BufSize ||
+		hdr.Index < 0 || hdr.Index >= hdr.BufSize || hdr.VacuumLen < 0 || hdr.VacuumLen > hdr.BufSize ||
+		hdr.End-hdr.Begin < hdr.BufSize-hdr.VacuumLen {
+		return ErrInvalidSnapshot
+	}
+	seg.rb.begin = hdr.Begin
+	seg.rb.end = hdr.End
+	seg.rb.index = int(hdr.Index)
+	seg.vacuumLen = hdr.VacuumLen
+	seg.lastVersion = hdr.LastVersion
+	seg.missCount = hdr.MissCount
+	seg.hitCount = hdr.HitCount
+	seg.totalCount = hdr.TotalCount
+	seg.totalTime = hdr.TotalTime
+	seg.totalEvacuate = hdr.TotalEvacuate
+	seg.totalExpired = hdr.TotalExpired
+	seg.overwrites = hdr.Overwrites
+	seg.touched = hdr.Touched
+	if err = seg.rebuildIndex(); err != nil {
+		return
+	}
+	seg.dropExpired()
+	return
+}
+
+// rebuildIndex fills the slots with the live entries found in the ring buffer.
+func (seg *segment) rebuildIndex() error {
+	seg.slotCap = 1
+	seg.slotsData = make([]entryPtr, 256*seg.slotCap)
+	seg.slotLens = [256]int32{}
+	seg.entryCount = 0
+	seg.pinnedCount = 0
+	seg.pinnedBytes = 0
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	end := seg.rb.End()
+	for off := end + seg.vacuumLen - seg.rb.Size(); off < end; {
+		if _, err := seg.rb.ReadAt(hdrBuf[:], off); err != nil {
+			return ErrInvalidSnapshot
+		}
+		entryLen := ENTRY_HDR_SIZE + int64(hdr.keyLen) + int64(hdr.valCap)
+		if off+entryLen > end || hdr.valLen+uint32(hdr.extLen) > hdr.valCap || hdr.tagLen() < 0 {
+			return ErrInvalidSnapshot
+		}
+		if !hdr.has(flagDeleted) {
+			slot := seg.getSlot(hdr.slotId)
+			seg.insertEntryPtr(hdr.slotId, hdr.hash16, off, entryPtrIdx(slot, hdr.hash16), hdr.keyLen)
+			seg.addPinned(hdr, 1)
+		}
+		off += entryLen
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package cache
+
+import "os"
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return ErrMmapUnsupported
+}
+
+func msyncFile(data []byte) error {
+	return ErrMmapUnsupported
+}
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"github.com/cespare/xxhash"
+	"sync"
+	"time"
+)
+
+const (
+	// minSegmentSize is the smallest ring buffer a segment gets.
+	minSegmentSize = minBufSize / segmentCount
+	// maxSegmentCount bounds Options.Segments.
+	maxSegmentCount = 1 << 16
+	// defaultMaxEntryRatio allows an entry to take a quarter of its segment.
+	defaultMaxEntryRatio = 0.25
+	// defaultMaxPinnedRatio lets pinned entries take half of their segment.
+	defaultMaxPinnedRatio = 0.5
+)
+
+// Hasher hashes keys, the hash selects the segment and the slot of an entry.
+type Hasher interface {
+	Sum64(data []byte) uint64
+}
+
+type xxHasher struct {
+}
+
+func (hasher xxHasher) Sum64(data []byte) uint64 {
+	return xxhash.Sum64(data)
+}
+
+// Options configures a Cache created by NewCacheWithOptions.
+// Zero values select the defaults used by NewCache.
+type Options struct {
+	// Size is the total size of the ring buffers in bytes.
+	// It is raised to at least 2KB per segment.
+	Size int
+	// Segments is the number of independently locked segments, 256 by default.
+	// It is rounded up to a power of two and capped at 65536.
+	Segments int
+	// Hasher hashes the keys, xxhash by default.
+	Hasher Hasher
+	// Timer provides the current time, the system clock by default.
+	Timer Timer
+	// MaxEntryRatio is the largest size of an entry relative to its segment,
+	// bigger entries are rejected with ErrLargeEntry. It must be in (0, 1], 0.25 by default.
+	MaxEntryRatio float64
+	// MaxPinnedRatio is the largest size of the entries pinned with SetPinned relative to
+	// their segment. It must be in (0, 1), 0.5 by default, so that pinned entries never
+	// leave a segment without room for new entries.
+	MaxPinnedRatio float64
+	// Admission decides whether new entries may evict existing ones, AdmissionAlways by default.
+	// Writes of new entries refused by the policy return ErrNotAdmitted.
+	// Compare HitRate with different policies to pick one for a workload.
+	Admission AdmissionPolicy
+	// Compression compresses values of at least CompressionThreshold bytes, CompressionNone by default.
+	// The codec is recorded per entry and values are decompressed transparently on reads.
+	Compression Compression
+	// CompressionThreshold is the smallest value that is compressed, 1KB by default.
+	CompressionThreshold int
+	// JanitorInterval enables a goroutine removing expired entries every interval,
+	// which keeps EntryCount close to the number of live entries. Close stops it.
+	JanitorInterval time.Duration
+	// JanitorBudget bounds the time of one sweep of the janitor, 1ms by default.
+	// The sweep holds a segment lock for 16 slots at a time and continues
+	// where the previous sweep stopped.
+	JanitorBudget time.Duration
+	// HotKeyCapacity enables the hot key report of HotKeys, tracking up to HotKeyCapacity keys
+	// by accesses and as many by bytes written. At most 2 * HotKeyCapacity keys are kept, each with
+	// three counters, however many distinct keys are used.
+	HotKeyCapacity int
+	// HotKeySampleRate samples one in HotKeySampleRate reads and writes of every segment
+	// for the hot key report, 16 by default.
+	HotKeySampleRate int
+	// ReadOptimized serves Get, GetWithBuf, GetWithExpiration, GetFn and PeekFn under a segment
+	// read lock, so reads of the same segment run in parallel. The access time of an entry is
+	// then updated lazily, by a read under the write lock once it is a minute old, which makes
+	// the eviction order coarser. Reads of expired, invalidated or stale entries still take the
+	// write lock, as do all reads if the TinyLFU admission policy is enabled.
+	ReadOptimized bool
+}
+
+// NewCacheWithOptions creates a cache configured by opts.
+func NewCacheWithOptions(opts Options) (cache *Cache) {
+	segments, segSize := opts.normalize()
+	cache = newCache(opts, segments, func(int) []byte {
+		return make([]byte, segSize)
+	})
+	if opts.JanitorInterval > 0 {
+		cache.startJanitor(opts.JanitorInterval, opts.JanitorBudget)
+	}
+	return
+}
+
+// normalize applies the defaults and returns the number of segments and the size of each.
+func (opts *Options) normalize() (segments, segSize int) {
+	segments = segmentCount
+	if opts.Segments > 0 {
+		segments = 1
+		for segments < opts.Segments && segments < maxSegmentCount {
+			segments <<= 1
+		}
+	}
+	size := opts.Size
+	if size < segments*minSegmentSize {
+		size = segments * minSegmentSize
+	}
+	if opts.Hasher == nil {
+		opts.Hasher = xxHasher{}
+	}
+	if opts.Timer == nil {
+		opts.Timer = defaultTimer{}
+	}
+	if opts.CompressionThreshold <= 0 {
+		opts.CompressionThreshold = defaultCompressionThreshold
+	}
+	if opts.MaxEntryRatio <= 0 || opts.MaxEntryRatio > 1 {
+		opts.MaxEntryRatio = defaultMaxEntryRatio
+	}
+	if opts.MaxPinnedRatio <= 0 || opts.MaxPinnedRatio >= 1 {
+		opts.MaxPinnedRatio = defaultMaxPinnedRatio
+	}
+	return segments, size / segments
+}
+
+// newCache creates a cache from normalized options, buffer returns the ring buffer of segment i.
+func newCache(opts Options, segments int, buffer func(i int) []byte) (cache *Cache) {
+	cache = &Cache{
+		locks:         make([]sync.RWMutex, segments),
+		segments:      make([]segment, segments),
+		segMask:       uint64(segments - 1),
+		hasher:        opts.Hasher,
+		timer:         opts.Timer,
+		readOptimized: opts.ReadOptimized,
+	}
+	cache.tags.init()
+	cache.cipher.init()
+	if opts.Compression != CompressionNone {
+		cache.compression = &compressor{codec: opts.Compression, threshold: opts.CompressionThreshold}
+	}
+	if opts.HotKeyCapacity > 0 {
+		cache.hot = newHotKeys(opts.HotKeyCapacity, opts.HotKeySampleRate)
+	}
+	for i := range cache.segments {
+		cache.segments[i] = newSegment(buffer(i), i, &opts)
+		cache.segments[i].tags = &cache.tags
+		cache.segments[i].compression = cache.compression
+		cache.segments[i].cipher = &cache.cipher
+		cache.segments[i].refresh = &cache.refresh
+		cache.segments[i].events = &cache.events
+		cache.segments[i].hot = cache.hot
+	}
+	return
+}
@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"errors"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMirrorRatio = 0.1
+
+var errFetchPanicked = errors.New("The fetch of the key panicked")
+
+// Loader loads the value of a key owned by this peer, e.g. from a database.
+type Loader func(key string) ([]byte, error)
+
+// GroupOptions configures a Group.
+type GroupOptions struct {
+	// Main caches the keys owned by this peer, it is required.
+	Main *cache.Cache
+	// Hot mirrors keys owned by other peers that are read often, nil disables the mirror.
+	Hot *cache.Cache
+	// ExpireSeconds is the expiration of the loaded values, 0 means they never expire.
+	ExpireSeconds int
+	// HotExpireSeconds is the expiration of the mirrored values, ExpireSeconds by default.
+	// Mirrored values are not updated by their owner, keep it short.
+	HotExpireSeconds int
+	// TTL is ExpireSeconds with millisecond precision, it takes precedence when set.
+	TTL time.Duration
+	// HotTTL is HotExpireSeconds with millisecond precision, it takes precedence when set.
+	HotTTL time.Duration
+	// MirrorRatio is the probability that a value fetched from its owner is mirrored in Hot,
+	// 0.1 by default. Keys read often are soon mirrored, keys read once rarely are.
+	MirrorRatio float64
+}
+
+// Group is a namespace of keys shared by all peers of a Pool.
+// Each key is loaded and cached by the peer owning it, the other peers fetch it from the owner.
+type Group struct {
+	name       string
+	pool       *Pool
+	loader     Loader
+	opts       GroupOptions
+	fetches    flightGroup
+	localLoads int64
+	peerLoads  int64
+	peerErrors int64
+}
+
+// NewGroup registers a group with the pool, the name must be the same on all peers.
+// It panics if a group with the name is already registered.
+func (p *Pool) NewGroup(name string, loader Loader, opts GroupOptions) *Group {
+	if opts.Main == nil {
+		panic("peer: NewGroup called without a main cache")
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Duration(opts.ExpireSeconds) * time.Second
+	}
+	if opts.HotTTL <= 0 {
+		opts.HotTTL = time.Duration(opts.HotExpireSeconds) * time.Second
+	}
+	if opts.HotTTL <= 0 {
+		opts.HotTTL = opts.TTL
+	}
+	if opts.MirrorRatio <= 0 {
+		opts.MirrorRatio = defaultMirrorRatio
+	}
+	g := &Group{name: name, pool: p, loader: loader, opts: opts}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.groups[name]; ok {
+		panic("peer: duplicate group " + name)
+	}
+	p.groups[name] = g
+	return g
+}
+
+// Get returns the value of the key from the local caches, from the peer owning it,
+// or from the loader if this peer owns it. If the owner can not be reached the
+// value is loaded locally, other errors of the owner are returned. Values larger than
+// the largest entry of the main cache are rejected with ErrValueTooLarge.
+func (g *Group) Get(key string) ([]byte, error) {
+	if value, err := g.opts.Main.Get([]byte(key)); err == nil {
+		return value, nil
+	}
+	if g.opts.Hot != nil {
+		if value, err := g.opts.Hot.Get([]byte(key)); err == nil {
+			return value, nil
+		}
+	}
+	owner := g.pool.owner(key)
+	if owner == "" {
+		return g.getLocally(key)
+	}
+	value, err := g.fetches.do(key, func() ([]byte, error) {
+		return g.pool.fetch(owner, g.name, key, g.opts.Main.MaxEntrySize())
+	})
+	if err != nil {
+		atomic.AddInt64(&g.peerErrors, 1)
+		if _, ok := err.(unreachableError); ok {
+			return g.getLocally(key)
+		}
+		return nil, err
+	}
+	atomic.AddInt64(&g.peerLoads, 1)
+	if g.opts.Hot != nil && rand.Float64() < g.opts.MirrorRatio {
+		g.opts.Hot.SetWithTTL([]byte(key), value, g.opts.HotTTL)
+	}
+	return value, nil
+}
+
+// getLocally returns the value from the main cache, loading it on a miss.
+func (g *Group) getLocally(key string) ([]byte, error) {
+	return g.opts.Main.GetOrLoadWithTTL([]byte(key), g.opts.TTL, func() ([]byte, error) {
+		atomic.AddInt64(&g.localLoads, 1)
+		return g.loader(key)
+	})
+}
+
+// LocalLoads returns the number of loader calls made by this peer.
+func (g *Group) LocalLoads() int64 {
+	return atomic.LoadInt64(&g.localLoads)
+}
+
+// PeerLoads returns the number of values fetched from other peers.
+func (g *Group) PeerLoads() int64 {
+	return atomic.LoadInt64(&g.peerLoads)
+}
+
+// PeerErrors returns the number of failed fetches from other peers.
+func (g *Group) PeerErrors() int64 {
+	return atomic.LoadInt64(&g.peerErrors)
+}
+
+// flightGroup collapses concurrent fetches of the same key.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// do calls fn once for concurrent callers with the same key. If fn panics, the waiting
+// callers get errFetchPanicked and the panic goes on in the calling goroutine.
+func (f *flightGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+	if f.calls == nil {
+		f.calls = make(map[string]*flight)
+	}
+	c := &flight{err: errFetchPanicked}
+	c.wg.Add(1)
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	defer func() {
+		c.wg.Done()
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+	}()
+	c.value, c.err = fn()
+	return c.value, c.err
+}
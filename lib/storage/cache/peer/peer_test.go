@@ -0,0 +1,185 @@
+package peer
+
+import (
+	"fmt"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testPeer struct {
+	server *httptest.Server
+	pool   *Pool
+	group  *Group
+	mu     sync.Mutex
+	loads  map[string]int
+}
+
+func newTestPeers(t *testing.T, n int) []*testPeer {
+	peers := make([]*testPeer, n)
+	urls := make([]string, n)
+	for i := range peers {
+		p := &testPeer{loads: make(map[string]int)}
+		p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.pool.ServeHTTP(w, r)
+		}))
+		peers[i] = p
+		urls[i] = p.server.URL
+	}
+	for i, p := range peers {
+		p := p
+		p.pool = NewPool(urls[i], PoolOptions{})
+		p.pool.SetPeers(urls...)
+		p.group = p.pool.NewGroup("users", func(key string) ([]byte, error) {
+			p.mu.Lock()
+			p.loads[key]++
+			p.mu.Unlock()
+			return []byte("value of " + key), nil
+		}, GroupOptions{
+			Main:        cache.NewCache(512 * 1024),
+			Hot:         cache.NewCache(512 * 1024),
+			MirrorRatio: 1,
+		})
+	}
+	return peers
+}
+
+func TestGroup(t *testing.T) {
+	peers := newTestPeers(t, 3)
+	defer func() {
+		for _, p := range peers {
+			p.server.Close()
+		}
+	}()
+
+	for _, p := range peers {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("user:%d", i)
+			value, err := p.group.Get(key)
+			if err != nil || string(value) != "value of "+key {
+				t.Fatalf("get %s: %s, %v", key, value, err)
+			}
+		}
+	}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		owner := peers[0].pool.owner(key)
+		total := 0
+		for _, p := range peers {
+			total += p.loads[key]
+			if p.loads[key] > 0 && owner != "" && owner != p.server.URL {
+				t.Fatalf("%s loaded by %s, owned by %s", key, p.server.URL, owner)
+			}
+		}
+		if total != 1 {
+			t.Fatalf("%s loaded %d times", key, total)
+		}
+	}
+	if peers[0].group.PeerLoads() == 0 || peers[0].group.LocalLoads() == 0 {
+		t.Fatalf("peer loads %d, local loads %d", peers[0].group.PeerLoads(), peers[0].group.LocalLoads())
+	}
+
+	// Without the other peers every key is loaded locally.
+	alone := peers[0]
+	alone.pool.SetPeers(alone.server.URL)
+	for i := 30; i < 40; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		if _, err := alone.group.Get(key); err != nil || alone.loads[key] != 1 {
+			t.Fatalf("get %s alone: loads %d, err %v", key, alone.loads[key], err)
+		}
+	}
+
+	// A peer that can not be reached is replaced by a local load.
+	down := peers[2]
+	down.server.Close()
+	before := peers[1].group.PeerErrors()
+	for i := 40; i < 70; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		if _, err := peers[1].group.Get(key); err != nil {
+			t.Fatalf("get %s with a peer down: %v", key, err)
+		}
+	}
+	if peers[1].group.PeerErrors() == before {
+		t.Fatal("no fetch from the peer that is down failed")
+	}
+}
+
+func TestGroupOwnerErrors(t *testing.T) {
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/large") {
+			w.Write(make([]byte, 1024*1024))
+			return
+		}
+		http.Error(w, "load failed", http.StatusInternalServerError)
+	}))
+	defer owner.Close()
+
+	loads := 0
+	pool := NewPool("http://127.0.0.1:1", PoolOptions{})
+	pool.SetPeers(owner.URL)
+	group := pool.NewGroup("users", func(key string) ([]byte, error) {
+		loads++
+		return []byte("value of " + key), nil
+	}, GroupOptions{Main: cache.NewCache(512 * 1024)})
+
+	// Keys the owner fails to load are not loaded by another peer.
+	if _, err := group.Get("user:1"); err == nil || !strings.Contains(err.Error(), "load failed") {
+		t.Fatalf("get with a failing owner: %v", err)
+	}
+	if _, err := group.Get("large"); err != ErrValueTooLarge {
+		t.Fatalf("get a large value: %v", err)
+	}
+	if loads != 0 || group.PeerErrors() != 2 {
+		t.Fatalf("loads %d, peer errors %d", loads, group.PeerErrors())
+	}
+}
+
+func TestFlightPanic(t *testing.T) {
+	var f flightGroup
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		f.do("key", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("fetch failed")
+		})
+	}()
+	<-started
+	done := make(chan error)
+	go func() {
+		_, err := f.do("key", func() ([]byte, error) { return nil, nil })
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil && err != errFetchPanicked {
+			t.Fatalf("waiter got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter is blocked after the panic")
+	}
+	if value, err := f.do("key", func() ([]byte, error) { return []byte("v"), nil }); err != nil || string(value) != "v" {
+		t.Fatalf("do after the panic: %s, %v", value, err)
+	}
+}
+
+func TestGroupTTL(t *testing.T) {
+	pool := NewPool("http://127.0.0.1:1", PoolOptions{})
+	main := cache.NewCache(512 * 1024)
+	group := pool.NewGroup("users", func(key string) ([]byte, error) {
+		return []byte("value of " + key), nil
+	}, GroupOptions{Main: main, ExpireSeconds: 60, TTL: 1500 * time.Millisecond})
+	if _, err := group.Get("user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := main.TTLDuration([]byte("user:1")); err != nil || ttl <= time.Second || ttl > 1500*time.Millisecond {
+		t.Fatalf("ttl %v, %v", ttl, err)
+	}
+}
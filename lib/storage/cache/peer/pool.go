@@ -0,0 +1,166 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBasePath = "/_peer/"
+	defaultReplicas = 50
+	defaultTimeout  = 5 * time.Second
+)
+
+var ErrUnknownGroup = errors.New("The group is not registered")
+var ErrValueTooLarge = errors.New("The value returned by the peer is too large")
+
+// unreachableError is returned by fetch when the owner could not be reached.
+type unreachableError struct {
+	err error
+}
+
+func (e unreachableError) Error() string {
+	return e.err.Error()
+}
+
+// PoolOptions configures a Pool.
+type PoolOptions struct {
+	// BasePath is the path the pool is served under on every peer, "/_peer/" by default.
+	BasePath string
+	// Replicas is the number of points of every peer on the hash ring, 50 by default.
+	Replicas int
+	// Client fetches values from the other peers, a client with a 5 second timeout by default.
+	Client *http.Client
+}
+
+// Pool knows the peers of this process and serves its groups to them over HTTP.
+// A key is fetched from the peer owning it with GET {peer}{BasePath}{group}/{key},
+// the response body is the value.
+type Pool struct {
+	self     string
+	basePath string
+	replicas int
+	client   *http.Client
+
+	mu     sync.RWMutex
+	ring   *Ring
+	groups map[string]*Group
+}
+
+// NewPool creates the pool of the peer with the base URL self, e.g. "http://10.0.0.1:8080".
+// The pool must be served at BasePath by the HTTP server of the peer.
+func NewPool(self string, opts PoolOptions) *Pool {
+	if opts.BasePath == "" {
+		opts.BasePath = defaultBasePath
+	}
+	if opts.Replicas <= 0 {
+		opts.Replicas = defaultReplicas
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	return &Pool{
+		self:     self,
+		basePath: opts.BasePath,
+		replicas: opts.Replicas,
+		client:   opts.Client,
+		ring:     NewRing(opts.Replicas, self),
+		groups:   make(map[string]*Group),
+	}
+}
+
+// SetPeers replaces the peers, which should include this one. It may be called at any time,
+// keys that move to another owner are loaded again by it, values cached by the previous
+// owner stay until they expire.
+func (p *Pool) SetPeers(peers ...string) {
+	ring := NewRing(p.replicas, peers...)
+	p.mu.Lock()
+	p.ring = ring
+	p.mu.Unlock()
+}
+
+// owner returns the peer owning the key, "" if it is this one.
+func (p *Pool) owner(key string) string {
+	p.mu.RLock()
+	owner := p.ring.Owner(key)
+	p.mu.RUnlock()
+	if owner == p.self {
+		return ""
+	}
+	return owner
+}
+
+func (p *Pool) group(name string) *Group {
+	p.mu.RLock()
+	g := p.groups[name]
+	p.mu.RUnlock()
+	return g
+}
+
+// fetch gets the value of the key from its owner, reading at most maxSize bytes.
+// It returns an unreachableError if the request could not be sent.
+func (p *Pool) fetch(owner, group, key string, maxSize int) ([]byte, error) {
+	u := owner + p.basePath + url.PathEscape(group) + "/" + url.PathEscape(key)
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return nil, unreachableError{err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s returned %s: %s", owner, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if len(body) > maxSize {
+		return nil, ErrValueTooLarge
+	}
+	return body, nil
+}
+
+// ServeHTTP answers the fetches of the other peers.
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.EscapedPath(), p.basePath) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.SplitN(r.URL.EscapedPath()[len(p.basePath):], "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := url.PathUnescape(parts[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := p.group(name)
+	if g == nil {
+		http.Error(w, ErrUnknownGroup.Error(), http.StatusNotFound)
+		return
+	}
+	value, err := g.getLocally(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
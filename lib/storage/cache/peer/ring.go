@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"github.com/cespare/xxhash"
+	"sort"
+	"strconv"
+)
+
+// Ring is a consistent hash ring of peers.
+// Every peer is placed on the ring replicas times, a key belongs to the first peer
+// clockwise from its hash, so adding or removing a peer only moves the keys next to it.
+type Ring struct {
+	replicas int
+	hashes   []uint64
+	owners   map[uint64]string
+}
+
+// NewRing creates a ring of peers, each placed replicas times.
+func NewRing(replicas int, peers ...string) *Ring {
+	r := &Ring{
+		replicas: replicas,
+		owners:   make(map[uint64]string, replicas*len(peers)),
+	}
+	for _, peer := range peers {
+		for i := 0; i < replicas; i++ {
+			h := xxhash.Sum64String(strconv.Itoa(i) + peer)
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the peer the key belongs to, "" if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := xxhash.Sum64String(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// SetPinned sets a value that evacuate keeps in the cache when it makes room for new
+// entries, e.g. configuration that must survive a burst of cold writes. The pinned entries
+// of a segment are limited to Options.MaxPinnedRatio of it, above the limit SetPinned
+// returns ErrPinnedLimit and leaves an existing entry unchanged.
+// Pinned entries still expire and are still removed by Del, Clear and a shrinking Resize.
+// Overwriting the key with any other setter unpins it.
+func (cache *Cache) SetPinned(key, value []byte, ttl time.Duration) (err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	v := cache.encodeValue(key, value)
+	cache.locks[segID].Lock()
+	err = cache.segments[segID].setEntry(key, v, nil, hashVal, 0, ttl, true)
+	cache.unlockSegment(segID)
+	return
+}
+
+// Unpin makes the entry evictable again.
+func (cache *Cache) Unpin(key []byte) (err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	cache.locks[segID].Lock()
+	err = cache.segments[segID].unpin(key, hashVal)
+	cache.unlockSegment(segID)
+	return
+}
+
+// PinnedCount returns the number of pinned entries.
+func (cache *Cache) PinnedCount() (count int64) {
+	for i := range cache.segments {
+		count += atomic.LoadInt64(&cache.segments[i].pinnedCount)
+	}
+	return
+}
+
+// PinnedBytes returns the space taken by the pinned entries, including their headers.
+func (cache *Cache) PinnedBytes() (size int64) {
+	for i := range cache.segments {
+		size += atomic.LoadInt64(&cache.segments[i].pinnedBytes)
+	}
+	return
+}
+
+func (seg *segment) unpin(key []byte, hashVal uint64) error {
+	slot := seg.getSlot(uint8(hashVal >> 8))
+	idx, match := seg.lookup(slot, uint16(hashVal>>16), key)
+	if !match {
+		return ErrNotFound
+	}
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	seg.rb.ReadAt(hdrBuf[:], slot[idx].offset)
+	if hdr.has(flagPinned) {
+		seg.addPinned(hdr, -1)
+		hdr.setFlag(flagPinned, false)
+		seg.rb.WriteAt(hdrBuf[:], slot[idx].offset)
+	}
+	return nil
+}
+
+// pinnable reports whether an entry of entryLen bytes can be pinned,
+// old is the header of the entry it replaces or nil.
+func (seg *segment) pinnable(entryLen int64, old *entryHdr) bool {
+	pinned := atomic.LoadInt64(&seg.pinnedBytes)
+	if old != nil {
+		oldLen := ENTRY_HDR_SIZE + int64(old.keyLen) + int64(old.valCap)
+		if entryLen < oldLen {
+			entryLen = oldLen
+		}
+		if old.has(flagPinned) {
+			pinned -= oldLen
+		}
+	}
+	return pinned+entryLen <= int64(float64(len(seg.rb.data))*seg.maxPinnedRatio)
+}
+
+// addPinned adds a pinned entry to the pinned statistics, or removes it if delta is -1.
+func (seg *segment) addPinned(hdr *entryHdr, delta int64) {
+	if hdr.has(flagPinned) {
+		atomic.AddInt64(&seg.pinnedCount, delta)
+		atomic.AddInt64(&seg.pinnedBytes, delta*(ENTRY_HDR_SIZE+int64(hdr.keyLen)+int64(hdr.valCap)))
+	}
+}
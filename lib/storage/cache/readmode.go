@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// lazyAccessTime is the age in seconds the access time of an entry may reach before
+// a read in read optimized mode takes the write lock to update it.
+const lazyAccessTime = 60
+
+// locateShared looks up the key under the segment read lock. A miss returns a nil hdr.
+// It returns ok false if the read has to be done under the write lock: the entry expired,
+// was invalidated, is stale, its access time is older than lazyAccessTime seconds,
+// or the segment uses an admission policy.
+func (seg *segment) locateShared(key []byte, hashVal uint64) (hdr *entryHdr, ptr *entryPtr, ok bool) {
+	if seg.admission != nil {
+		return nil, nil, false
+	}
+	slotId := uint8(hashVal >> 8)
+	hash16 := uint16(hashVal >> 16)
+	slot := seg.getSlot(slotId)
+	idx, match := seg.lookup(slot, hash16, key)
+	if match {
+		ptr = &slot[idx]
+		var hdrBuf [ENTRY_HDR_SIZE]byte
+		seg.rb.ReadAt(hdrBuf[:], ptr.offset)
+		hdr = (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+		nowMs := nowMilli(seg.timer)
+		if hdr.expireAt != 0 && hdr.expireAt <= nowMs || hdr.has(flagStaleDelta|flagStaleAt) && seg.staleAt(hdr, ptr.offset) <= nowMs ||
+			uint32(nowMs/1000)-hdr.accessTime >= lazyAccessTime || seg.invalidated(hdr, ptr.offset) {
+			return nil, nil, false
+		}
+	} else {
+		atomic.AddInt64(&seg.missCount, 1)
+	}
+	return hdr, ptr, true
+}
+
+func (seg *segment) getShared(key, buf []byte, hashVal uint64) (value []byte, expireAt int64, ok bool, err error) {
+	hdr, ptr, ok := seg.locateShared(key, hashVal)
+	if !ok {
+		return
+	}
+	if hdr == nil {
+		return nil, 0, true, ErrNotFound
+	}
+	if value, err = seg.readValue(hdr, ptr.offset, buf); err == ErrDecrypt {
+		// The entry is dropped under the write lock.
+		return nil, 0, false, nil
+	} else if err != nil {
+		return
+	}
+	atomic.AddInt64(&seg.hitCount, 1)
+	return value, hdr.expireAt, true, nil
+}
+
+func (seg *segment) viewShared(key []byte, fn func([]byte) error, hashVal uint64) (ok bool, err error) {
+	hdr, ptr, ok := seg.locateShared(key, hashVal)
+	if !ok {
+		return
+	}
+	if hdr == nil {
+		return true, ErrNotFound
+	}
+	var val []byte
+	if hdr.plain() {
+		val, err = seg.rb.Slice(ptr.offset+ENTRY_HDR_SIZE+int64(hdr.keyLen), int64(hdr.valLen))
+	} else {
+		val, err = seg.readValue(hdr, ptr.offset, nil)
+	}
+	if err == ErrDecrypt {
+		return false, nil
+	} else if err != nil {
+		return true, err
+	}
+	err = fn(val)
+	atomic.AddInt64(&seg.hitCount, 1)
+	return true, err
+}
+
+// getReadOptimized serves Get, GetWithBuf and GetWithExpiration in read optimized mode.
+// It returns ok false if the read has to be retried under the write lock.
+func (cache *Cache) getReadOptimized(key, buf []byte, hashVal uint64) (value []byte, expireAt int64, ok bool, err error) {
+	segID := cache.segmentID(hashVal)
+	cache.locks[segID].RLock()
+	value, expireAt, ok, err = cache.segments[segID].getShared(key, buf, hashVal)
+	cache.locks[segID].RUnlock()
+	if ok && err == nil {
+		cache.recordSharedHit(segID, key)
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultRefreshWorkers is used when SetRefresher is called with workers <= 0.
+	defaultRefreshWorkers = 4
+	// refreshQueuePerWorker bounds the refreshes waiting for a worker,
+	// refreshes beyond the bound are dropped and retried by a later read.
+	refreshQueuePerWorker = 64
+)
+
+// RefreshFunc loads a fresh value for a stale key, with the soft and hard ttl to store it with.
+type RefreshFunc func(key []byte) (value []byte, softTTL, ttl time.Duration, err error)
+
+type refreshJob struct {
+	hashVal uint64
+	key     []byte
+}
+
+// refreshPool is the set of workers started by one SetRefresher call.
+type refreshPool struct {
+	fn      RefreshFunc
+	queue   chan refreshJob
+	pending map[uint64]struct{} // keys queued or being refreshed, guarded by refresher.mu.
+	wg      sync.WaitGroup
+}
+
+// refresher runs the background refreshes of stale entries.
+type refresher struct {
+	mu        sync.Mutex
+	pool      *refreshPool
+	active    int32 // 1 if pool is set, read by the segments without taking mu.
+	refreshes int64
+	errors    int64
+	dropped   int64
+}
+
+// SetRefresher registers fn to refresh entries written by SetWithSoftTTL.
+// A read of an entry past its soft ttl returns the stale value and queues a refresh,
+// at most one refresh per key is queued or running at a time.
+// Refreshes run on a pool of workers goroutines, 4 if workers <= 0. When all workers are
+// busy and the queue is full the refresh is dropped, a later read queues it again.
+// Passing nil stops the workers after the queued refreshes are done, as does Close.
+func (cache *Cache) SetRefresher(fn RefreshFunc, workers int) {
+	r := &cache.refresh
+	r.stop()
+	if fn == nil {
+		return
+	}
+	if workers <= 0 {
+		workers = defaultRefreshWorkers
+	}
+	p := &refreshPool{
+		fn:      fn,
+		queue:   make(chan refreshJob, workers*refreshQueuePerWorker),
+		pending: make(map[uint64]struct{}),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go cache.refreshWorker(p)
+	}
+	r.mu.Lock()
+	old := r.pool
+	r.pool = p
+	atomic.StoreInt32(&r.active, 1)
+	r.mu.Unlock()
+	if old != nil {
+		// Another SetRefresher call raced with this one.
+		close(old.queue)
+		old.wg.Wait()
+	}
+}
+
+// SetWithSoftTTL sets the value with a soft and a hard time to live.
+// After softTTL reads still return the value but refresh it in the background through
+// the function registered with SetRefresher, after ttl the entry is gone.
+// A ttl <= 0 means the entry never expires.
+func (cache *Cache) SetWithSoftTTL(key, value []byte, softTTL, ttl time.Duration) (err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	v := cache.encodeValue(key, value)
+	cache.locks[segID].Lock()
+	err = cache.segments[segID].setEntry(key, v, nil, hashVal, softTTL, ttl, false)
+	cache.unlockSegment(segID)
+	return
+}
+
+func (cache *Cache) refreshWorker(p *refreshPool) {
+	defer p.wg.Done()
+	r := &cache.refresh
+	for job := range p.queue {
+		value, softTTL, ttl, err := p.load(job.key)
+		if err == nil {
+			err = cache.SetWithSoftTTL(job.key, value, softTTL, ttl)
+		}
+		if err == nil {
+			atomic.AddInt64(&r.refreshes, 1)
+		} else {
+			atomic.AddInt64(&r.errors, 1)
+		}
+		r.mu.Lock()
+		delete(p.pending, job.hashVal)
+		r.mu.Unlock()
+	}
+}
+
+// load calls fn, a panic is reported as ErrLoaderPanic so the worker keeps running.
+func (p *refreshPool) load(key []byte) (value []byte, softTTL, ttl time.Duration, err error) {
+	defer func() {
+		if recover() != nil {
+			err = ErrLoaderPanic
+		}
+	}()
+	return p.fn(key)
+}
+
+// schedule queues a refresh of the key unless one is already queued or running.
+func (r *refresher) schedule(job refreshJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.pool
+	if p == nil {
+		return
+	}
+	if _, ok := p.pending[job.hashVal]; ok {
+		// A hash collision with another key only delays the refresh of this one.
+		return
+	}
+	select {
+	case p.queue <- job:
+		p.pending[job.hashVal] = struct{}{}
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+// stop stops the workers after the queued refreshes are done.
+func (r *refresher) stop() {
+	r.mu.Lock()
+	p := r.pool
+	r.pool = nil
+	atomic.StoreInt32(&r.active, 0)
+	r.mu.Unlock()
+	if p != nil {
+		close(p.queue)
+		p.wg.Wait()
+	}
+}
+
+// recordStale remembers a read of a stale entry, the refresh is queued by Cache.unlockSegment.
+func (seg *segment) recordStale(key []byte, hashVal uint64) {
+	atomic.AddInt64(&seg.staleHits, 1)
+	if seg.refresh == nil || atomic.LoadInt32(&seg.refresh.active) == 0 {
+		return
+	}
+	for _, job := range seg.stale {
+		if job.hashVal == hashVal && bytes.Equal(job.key, key) {
+			return
+		}
+	}
+	seg.stale = append(seg.stale, refreshJob{hashVal: hashVal, key: append([]byte(nil), key...)})
+}
+
+// StaleHitCount returns the number of reads that returned a value past its soft ttl.
+func (cache *Cache) StaleHitCount() (count int64) {
+	for i := range cache.segments {
+		count += atomic.LoadInt64(&cache.segments[i].staleHits)
+	}
+	return
+}
+
+// RefreshCount returns the number of entries refreshed in the background.
+func (cache *Cache) RefreshCount() int64 {
+	return atomic.LoadInt64(&cache.refresh.refreshes)
+}
+
+// RefreshErrorCount returns the number of background refreshes that failed.
+func (cache *Cache) RefreshErrorCount() int64 {
+	return atomic.LoadInt64(&cache.refresh.errors)
+}
+
+// RefreshDroppedCount returns the number of refreshes dropped because the queue was full.
+func (cache *Cache) RefreshDroppedCount() int64 {
+	return atomic.LoadInt64(&cache.refresh.dropped)
+}
+
+func (r *refresher) resetStatistics() {
+	atomic.StoreInt64(&r.refreshes, 0)
+	atomic.StoreInt64(&r.errors, 0)
+	atomic.StoreInt64(&r.dropped, 0)
+}
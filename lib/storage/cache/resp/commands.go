@@ -0,0 +1,446 @@
+package resp
+
+import (
+	"fmt"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultScanCount = 10
+
+// dispatch runs one command, it returns true if the connection should be closed.
+func (c *conn) dispatch(args [][]byte) (quit bool) {
+	atomic.AddInt64(&c.server.commands, 1)
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	arity := func(min, max int) bool {
+		if len(args) < min || max >= 0 && len(args) > max {
+			c.writeError("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+			return false
+		}
+		return true
+	}
+	switch name {
+	case "GET":
+		if arity(1, 1) {
+			c.get(args[0])
+		}
+	case "SET":
+		if arity(2, -1) {
+			c.set(args)
+		}
+	case "DEL":
+		if arity(1, -1) {
+			c.del(args)
+		}
+	case "EXISTS":
+		if arity(1, -1) {
+			c.exists(args)
+		}
+	case "EXPIRE":
+		if arity(2, 2) {
+			c.expire(args[0], args[1])
+		}
+	case "TTL", "PTTL":
+		if arity(1, 1) {
+			c.ttl(args[0], name == "PTTL")
+		}
+	case "INCR", "DECR":
+		if arity(1, 1) {
+			delta := int64(1)
+			if name == "DECR" {
+				delta = -1
+			}
+			c.incr(args[0], delta)
+		}
+	case "INCRBY", "DECRBY":
+		if arity(2, 2) {
+			delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+			if err != nil {
+				c.writeError("ERR value is not an integer or out of range")
+			} else if name == "DECRBY" {
+				c.incr(args[0], -delta)
+			} else {
+				c.incr(args[0], delta)
+			}
+		}
+	case "MGET":
+		if arity(1, -1) {
+			c.mget(args)
+		}
+	case "MSET":
+		if arity(2, -1) {
+			c.mset(args)
+		}
+	case "SCAN":
+		if arity(1, -1) {
+			c.scan(args)
+		}
+	case "FLUSHDB", "FLUSHALL":
+		if arity(0, 1) {
+			c.server.cache.Clear()
+			c.writeSimple("OK")
+		}
+	case "PING":
+		if arity(0, 1) {
+			if len(args) == 1 {
+				c.writeBulk(args[0])
+			} else {
+				c.writeSimple("PONG")
+			}
+		}
+	case "INFO":
+		if arity(0, 1) {
+			c.info()
+		}
+	case "SELECT":
+		if arity(1, 1) {
+			if string(args[0]) == "0" {
+				c.writeSimple("OK")
+			} else {
+				c.writeError("ERR DB index is out of range")
+			}
+		}
+	case "QUIT":
+		c.writeSimple("OK")
+		return true
+	default:
+		c.writeError("ERR unknown command '" + strings.ToLower(name) + "'")
+	}
+	return false
+}
+
+func (c *conn) get(key []byte) {
+	value, err := c.server.cache.Get(key)
+	if err != nil {
+		c.writeNull()
+		return
+	}
+	c.writeBulk(value)
+}
+
+// set implements SET key value [EX seconds|PX milliseconds] [NX|XX].
+func (c *conn) set(args [][]byte) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case (opt == "EX" || opt == "PX") && ttl == 0 && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				c.writeError("ERR value is not an integer or out of range")
+				return
+			}
+			if n <= 0 {
+				c.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+	cc := c.server.cache
+	var err error
+	switch {
+	case nx:
+		_, err = cc.CompareAndSet(key, value, 0, ttl)
+	case xx:
+		for {
+			var ver uint32
+			if _, ver, err = cc.GetWithVersion(key); err != nil {
+				break
+			}
+			if _, err = cc.CompareAndSet(key, value, ver, ttl); err != cache.ErrVersionMismatch {
+				break
+			}
+		}
+	default:
+		err = cc.SetWithTTL(key, value, ttl)
+	}
+	switch err {
+	case nil:
+		c.writeSimple("OK")
+	case cache.ErrVersionMismatch, cache.ErrNotFound:
+		c.writeNull()
+	default:
+		c.writeError("ERR " + err.Error())
+	}
+}
+
+func (c *conn) del(keys [][]byte) {
+	var n int64
+	for _, key := range keys {
+		if c.server.cache.Del(key) {
+			n++
+		}
+	}
+	c.writeInt(n)
+}
+
+func (c *conn) exists(keys [][]byte) {
+	var n int64
+	for _, key := range keys {
+		if _, err := c.server.cache.TTLDuration(key); err == nil {
+			n++
+		}
+	}
+	c.writeInt(n)
+}
+
+func (c *conn) expire(key, arg []byte) {
+	seconds, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		c.writeError("ERR value is not an integer or out of range")
+		return
+	}
+	if seconds <= 0 {
+		if c.server.cache.Del(key) {
+			c.writeInt(1)
+		} else {
+			c.writeInt(0)
+		}
+		return
+	}
+	if c.server.cache.TouchWithTTL(key, time.Duration(seconds)*time.Second) != nil {
+		c.writeInt(0)
+		return
+	}
+	c.writeInt(1)
+}
+
+func (c *conn) ttl(key []byte, milli bool) {
+	d, err := c.server.cache.TTLDuration(key)
+	switch {
+	case err != nil:
+		c.writeInt(-2)
+	case d == 0:
+		c.writeInt(-1)
+	case milli:
+		c.writeInt(int64(d / time.Millisecond))
+	default:
+		c.writeInt(int64((d + time.Second/2) / time.Second))
+	}
+}
+
+// incr adds delta to a decimal value, a missing key starts at 0 and does not expire.
+func (c *conn) incr(key []byte, delta int64) {
+	cc := c.server.cache
+	for {
+		value, ver, err := cc.GetWithVersion(key)
+		var n int64
+		var ttl time.Duration
+		if err == nil {
+			if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				c.writeError("ERR value is not an integer or out of range")
+				return
+			}
+			if ttl, err = cc.TTLDuration(key); err != nil {
+				continue
+			}
+		}
+		if delta > 0 && n > n+delta || delta < 0 && n < n+delta {
+			c.writeError("ERR increment or decrement would overflow")
+			return
+		}
+		n += delta
+		_, err = cc.CompareAndSet(key, strconv.AppendInt(nil, n, 10), ver, ttl)
+		if err == cache.ErrVersionMismatch {
+			continue
+		}
+		if err != nil {
+			c.writeError("ERR " + err.Error())
+			return
+		}
+		c.writeInt(n)
+		return
+	}
+}
+
+func (c *conn) mget(keys [][]byte) {
+	values, found := c.server.cache.MultiGet(keys)
+	c.writeArrayLen(len(keys))
+	for i := range keys {
+		if found[i] {
+			c.writeBulk(values[i])
+		} else {
+			c.writeNull()
+		}
+	}
+}
+
+func (c *conn) mset(args [][]byte) {
+	if len(args)%2 != 0 {
+		c.writeError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	keys := make([][]byte, 0, len(args)/2)
+	values := make([][]byte, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+		values = append(values, args[i+1])
+	}
+	for _, err := range c.server.cache.MultiSet(keys, values, 0) {
+		if err != nil {
+			c.writeError("ERR " + err.Error())
+			return
+		}
+	}
+	c.writeSimple("OK")
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count].
+func (c *conn) scan(args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		c.writeError("ERR invalid cursor")
+		return
+	}
+	count := defaultScanCount
+	var pattern []byte
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		if i+1 >= len(args) {
+			c.writeError("ERR syntax error")
+			return
+		}
+		i++
+		switch opt {
+		case "MATCH":
+			pattern = args[i]
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i])); err != nil || count < 1 {
+				c.writeError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+	var filter func(key []byte) bool
+	if pattern != nil {
+		filter = func(key []byte) bool {
+			return match(pattern, key)
+		}
+	}
+	keys, next := c.server.cache.Scan(cursor, count, filter)
+	c.writeArrayLen(2)
+	c.writeBulk(strconv.AppendUint(nil, next, 10))
+	c.writeArrayLen(len(keys))
+	for _, key := range keys {
+		c.writeBulk(key)
+	}
+}
+
+func (c *conn) info() {
+	s := c.server
+	cc := s.cache
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\nprocess_id:%d\r\nuptime_in_seconds:%d\r\n\r\n",
+		os.Getpid(), int64(time.Since(s.started)/time.Second))
+	fmt.Fprintf(&b, "# Clients\r\nconnected_clients:%d\r\n\r\n", s.tcp.CurrConns())
+	fmt.Fprintf(&b, "# Stats\r\ntotal_connections_received:%d\r\ntotal_commands_processed:%d\r\n",
+		s.tcp.TotalConns(), atomic.LoadInt64(&s.commands))
+	fmt.Fprintf(&b, "keyspace_hits:%d\r\nkeyspace_misses:%d\r\nexpired_keys:%d\r\nevicted_keys:%d\r\n",
+		cc.HitCount(), cc.MissCount(), cc.ExpiredCount(), cc.EvacuateCount())
+	fmt.Fprintf(&b, "overwritten_keys:%d\r\ntouched_keys:%d\r\naverage_access_time:%d\r\n\r\n",
+		cc.OverwriteCount(), cc.TouchedCount(), cc.AverageAccessTime())
+	fmt.Fprintf(&b, "# Keyspace\r\ndb0:keys=%d\r\n", cc.EntryCount())
+	c.writeBulk([]byte(b.String()))
+}
+
+// match reports whether key matches the glob-style pattern of SCAN MATCH,
+// supporting *, ?, [...] with ranges and ^ negation, and \ escapes.
+// Only the position of the last * is kept for backtracking, so the time is bounded
+// by len(pattern)*len(key) whatever the number of *.
+func match(pattern, key []byte) bool {
+	p, k := 0, 0
+	star, starKey := -1, 0
+	for k < len(key) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, starKey = p, k
+			continue
+		}
+		if p < len(pattern) {
+			if n, ok := matchByte(pattern[p:], key[k]); ok {
+				p += n
+				k++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last * take one more byte.
+		starKey++
+		p, k = star, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte matches b against the first element of pattern, which is not a *.
+// It returns the length of the element.
+func matchByte(pattern []byte, b byte) (n int, ok bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		i := 1
+		negate := i < len(pattern) && pattern[i] == '^'
+		if negate {
+			i++
+		}
+		matched := false
+		for i < len(pattern) && pattern[i] != ']' {
+			if pattern[i] == '\\' && i+1 < len(pattern) {
+				i++
+			}
+			if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+				lo, hi := pattern[i], pattern[i+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				if b >= lo && b <= hi {
+					matched = true
+				}
+				i += 3
+			} else {
+				if pattern[i] == b {
+					matched = true
+				}
+				i++
+			}
+		}
+		if i < len(pattern) {
+			i++
+		}
+		return i, matched != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == b
+		}
+	}
+	return 1, pattern[0] == b
+}
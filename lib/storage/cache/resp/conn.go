@@ -0,0 +1,149 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/godofcc/go-common/lib/storage/cache/internal/tcpserver"
+	"io"
+	"strconv"
+)
+
+const (
+	maxLineLen  = 64 * 1024
+	maxArgs     = 1024 * 1024
+	maxBulkSize = 512 * 1024 * 1024
+)
+
+var errProtocol = errors.New("Protocol error")
+
+type conn struct {
+	server *Server
+	nc     *tcpserver.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+}
+
+func (c *conn) serve() {
+	for {
+		if !c.nc.SetIdle(true) {
+			return
+		}
+		args, err := c.readCommand()
+		if !c.nc.SetIdle(false) && err != nil {
+			return
+		}
+		if err == errProtocol {
+			c.writeError("ERR Protocol error")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) > 0 && c.dispatch(args) {
+			c.w.Flush()
+			return
+		}
+		if c.r.Buffered() == 0 {
+			if c.w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLineLen {
+		return nil, errProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// readCommand reads a command sent as an array of bulk strings or as an inline command.
+func (c *conn) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		fields := bytes.Fields(line)
+		args := make([][]byte, len(fields))
+		for i, f := range fields {
+			args[i] = append([]byte(nil), f...)
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, errProtocol
+	}
+	// The lengths are sent by the client, buffers grow with the data actually received.
+	var args [][]byte
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, errProtocol
+		}
+		var buf bytes.Buffer
+		if _, err = io.CopyN(&buf, c.r, int64(size)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		arg := buf.Bytes()
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func (c *conn) writeSimple(s string) {
+	c.w.WriteByte('+')
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) writeError(s string) {
+	c.w.WriteByte('-')
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) writeInt(n int64) {
+	c.w.WriteByte(':')
+	c.w.WriteString(strconv.FormatInt(n, 10))
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) writeBulk(b []byte) {
+	c.w.WriteByte('$')
+	c.w.WriteString(strconv.Itoa(len(b)))
+	c.w.WriteString("\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) writeNull() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *conn) writeArrayLen(n int) {
+	c.w.WriteByte('*')
+	c.w.WriteString(strconv.Itoa(n))
+	c.w.WriteString("\r\n")
+}
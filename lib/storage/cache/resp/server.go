@@ -0,0 +1,59 @@
+// Package memcached serves a cache.Cache over the Redis serialization protocol (RESP2).
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"github.com/godofcc/go-common/lib/storage/cache/internal/tcpserver"
+	"net"
+	"time"
+)
+
+var ErrServerClosed = errors.New("The RESP server is closed")
+
+// Server serves a cache to Redis clients as a single database of string keys.
+// Values are stored as they are, so the cache may be shared with code using it directly.
+// Counters are decimal strings as in Redis, not the 8 byte values of cache.Incr.
+type Server struct {
+	cache   *cache.Cache
+	started time.Time
+	tcp     *tcpserver.Server
+
+	commands int64
+}
+
+// NewServer creates a server for the cache.
+func NewServer(c *cache.Cache) *Server {
+	s := &Server{cache: c, started: time.Now()}
+	s.tcp = tcpserver.New(s.serveConn, ErrServerClosed)
+	return s
+}
+
+func (s *Server) serveConn(nc *tcpserver.Conn) {
+	c := &conn{server: s, nc: nc, r: bufio.NewReaderSize(nc, maxLineLen), w: bufio.NewWriter(nc)}
+	c.serve()
+}
+
+// ListenAndServe listens on the TCP address addr and serves the connections, see Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	return s.tcp.ListenAndServe(addr)
+}
+
+// Serve accepts connections on l until Shutdown is called, it then returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	return s.tcp.Serve(l)
+}
+
+// Shutdown stops accepting connections, lets the commands in progress finish,
+// closes all connections and waits for them to be closed. Commands whose arguments
+// are not received within a second are dropped.
+func (s *Server) Shutdown() error {
+	return s.tcp.Shutdown()
+}
+
+// OnShutdown implements shutdown.ShutdownCallback, register the server with
+// GracefulShutdown.AddShutdownCallback to shut it down with the process.
+func (s *Server) OnShutdown(string) error {
+	return s.Shutdown()
+}
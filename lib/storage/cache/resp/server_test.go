@@ -0,0 +1,184 @@
+package resp
+
+import (
+	"bufio"
+	redis "github.com/go-redis/redis/v7"
+	"github.com/godofcc/go-common/lib/storage/cache"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(cache.NewCache(512 * 1024))
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	client := redis.NewClient(&redis.Options{Addr: l.Addr().String(), MaxRetries: -1})
+	defer client.Close()
+
+	if pong, err := client.Ping().Result(); err != nil || pong != "PONG" {
+		t.Fatalf("PING: %s, %v", pong, err)
+	}
+	if err := client.Set("a", "1", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := client.SetNX("a", "2", time.Minute).Result(); err != nil || ok {
+		t.Fatalf("SET NX of an existing key: %v, %v", ok, err)
+	}
+	if ok, err := client.SetXX("b", "2", time.Minute).Result(); err != nil || ok {
+		t.Fatalf("SET XX of a missing key: %v, %v", ok, err)
+	}
+	if err := client.Set("b", "x", time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.Get("b").Result(); err != nil || value != "x" {
+		t.Fatalf("GET: %s, %v", value, err)
+	}
+	if _, err := client.Get("c").Result(); err != redis.Nil {
+		t.Fatalf("GET of a missing key: %v", err)
+	}
+	if ttl, err := client.TTL("b").Result(); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL: %v, %v", ttl, err)
+	}
+	if ttl, err := client.TTL("a").Result(); err != nil || ttl != -1 {
+		t.Fatalf("TTL without expiration: %v, %v", ttl, err)
+	}
+	if ok, err := client.Expire("a", time.Hour).Result(); err != nil || !ok {
+		t.Fatalf("EXPIRE: %v, %v", ok, err)
+	}
+	if n, err := client.Incr("a").Result(); err != nil || n != 2 {
+		t.Fatalf("INCR: %d, %v", n, err)
+	}
+	if n, err := client.Incr("counter").Result(); err != nil || n != 1 {
+		t.Fatalf("INCR of a missing key: %d, %v", n, err)
+	}
+	if err := client.Incr("b").Err(); err == nil {
+		t.Fatal("INCR of a non-numeric value")
+	}
+	if err := client.MSet("k1", "v1", "k2", "v2").Err(); err != nil {
+		t.Fatal(err)
+	}
+	values, err := client.MGet("k1", "missing", "k2").Result()
+	if err != nil || len(values) != 3 || values[0] != "v1" || values[1] != nil || values[2] != "v2" {
+		t.Fatalf("MGET: %v, %v", values, err)
+	}
+	if n, err := client.Exists("k1", "k2", "missing").Result(); err != nil || n != 2 {
+		t.Fatalf("EXISTS: %d, %v", n, err)
+	}
+
+	var keys []string
+	iter := client.Scan(0, "k*", 1).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	sort.Strings(keys)
+	if iter.Err() != nil || strings.Join(keys, ",") != "k1,k2" {
+		t.Fatalf("SCAN: %v, %v", keys, iter.Err())
+	}
+	if info, err := client.Info().Result(); err != nil || !strings.Contains(info, "db0:keys=5") {
+		t.Fatalf("INFO: %q, %v", info, err)
+	}
+	if n, err := client.Del("k1", "k2", "missing").Result(); err != nil || n != 2 {
+		t.Fatalf("DEL: %d, %v", n, err)
+	}
+	if err := client.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Exists("a", "b", "counter").Result(); err != nil || n != 0 {
+		t.Fatalf("EXISTS after FLUSHDB: %d, %v", n, err)
+	}
+
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"a*b*c", "abbbc", true},
+		{"a*b*c", "abcb", false},
+		{"**", "", true},
+		{"a*", "", false},
+		{"[a-", "b", false},
+		{strings.Repeat("a*", 12) + "b", strings.Repeat("a", 60), false},
+	} {
+		if got := match([]byte(c.pattern), []byte(c.key)); got != c.want {
+			t.Errorf("match(%q, %q) = %v", c.pattern, c.key, got)
+		}
+	}
+}
+
+func TestInlineCommand(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(cache.NewCache(512 * 1024))
+	go s.Serve(l)
+	defer s.Shutdown()
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(nc)
+	// Inline commands up to maxLineLen are accepted, longer ones are protocol errors.
+	for _, c := range []struct {
+		keys int
+		want string
+	}{
+		{2000, ":0\r\n"},
+		{maxLineLen / 4, "-ERR Protocol error\r\n"},
+	} {
+		nc.Write([]byte("EXISTS" + strings.Repeat(" key", c.keys) + "\r\n"))
+		if line, err := r.ReadString('\n'); err != nil || line != c.want {
+			t.Fatalf("%d keys: %q, %v", c.keys, line, err)
+		}
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(cache.NewCache(512 * 1024))
+	go s.Serve(l)
+	defer s.Shutdown()
+	for _, req := range []string{"*-1\r\n", "*1\r\n$-5\r\n", "*2147483647\r\n"} {
+		nc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc.Write([]byte(req))
+		nc.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(nc).ReadString('\n')
+		nc.Close()
+		if err != nil || line != "-ERR Protocol error\r\n" {
+			t.Fatalf("%q: %q, %v", req, line, err)
+		}
+	}
+}
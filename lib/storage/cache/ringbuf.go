@@ -17,7 +17,12 @@ type RingBuf struct {
 }
 
 func NewRingBuf(size int, begin int64) (rb RingBuf) {
-	rb.data = make([]byte, size)
+	return newRingBufWithData(make([]byte, size), begin)
+}
+
+// newRingBufWithData creates a ring buffer on top of data, e.g. a memory mapped file.
+func newRingBufWithData(data []byte, begin int64) (rb RingBuf) {
+	rb.data = data
 	rb.Reset(begin)
 	return
 }
@@ -226,7 +231,7 @@ func (rb *RingBuf) Resize(newSize int) {
 		copy(newData[n:], rb.data[:offset])
 	}
 	rb.data = newData
-	rb.index = 0
+	rb.index = int(rb.end-rb.begin) % newSize
 }
 
 func (rb *RingBuf) Skip(length int64) {
@@ -3,15 +3,18 @@ package cache
 import (
 	"errors"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 const HASH_ENTRY_SIZE = 16
-const ENTRY_HDR_SIZE = 24
+const ENTRY_HDR_SIZE = 32
 
 var ErrLargeKey = errors.New("The key is larger than 65535")
 var ErrLargeEntry = errors.New("The entry size is larger than 1/1024 of cache size")
 var ErrNotFound = errors.New("Entry not found")
+var ErrVersionMismatch = errors.New("Entry version mismatch")
+var ErrPinnedLimit = errors.New("The pinned entries exceed the pinned size limit of the segment")
 
 type entryPtr struct {
 	offset   int64
@@ -22,105 +25,209 @@ type entryPtr struct {
 
 type entryHdr struct {
 	accessTime uint32
-	expireAt   uint32
 	keyLen     uint16
 	hash16     uint16
+	expireAt   int64 // Unix time in milliseconds, 0 means the entry never expires.
 	valLen     uint32
-	valCap     uint32
-	deleted    bool
+	valCap     uint32 // space for the value and the trailer.
 	slotId     uint8
-	reserved   uint32
+	flags      uint8  // see flagDeleted.
+	extLen     uint16 // length of the trailer after the value, the entryMeta and the tag data.
+	version    uint32 // changes on every write of the entry, 0 is never used.
 }
 
+// entryHdr is read and written through ENTRY_HDR_SIZE byte buffers, keep the sizes equal.
+var _ [ENTRY_HDR_SIZE - unsafe.Sizeof(entryHdr{})]byte
+var _ [unsafe.Sizeof(entryHdr{}) - ENTRY_HDR_SIZE]byte
+
 type segment struct {
-	rb            RingBuf
-	segId         int
-	_             uint32
-	missCount     int64
-	hitCount      int64
-	entryCount    int64
-	totalCount    int64
-	totalTime     int64
-	timer         Timer
-	totalEvacuate int64
-	totalExpired  int64
-	overwrites    int64
-	touched       int64
-	vacuumLen     int64
-	slotLens      [256]int32 // The actual length for every slot.
-	slotCap       int32      // max number of entry pointers a slot can hold.
-	slotsData     []entryPtr // shared by all 256 slots
-}
-
-func newSegment(bufSize int, segId int, timer Timer) (seg segment) {
-	seg.rb = NewRingBuf(bufSize, 0)
+	rb               RingBuf
+	segId            int
+	_                uint32
+	missCount        int64
+	hitCount         int64
+	entryCount       int64
+	totalCount       int64
+	totalTime        int64
+	timer            Timer
+	totalEvacuate    int64
+	totalExpired     int64
+	overwrites       int64
+	touched          int64
+	vacuumLen        int64
+	slotLens         [256]int32 // The actual length for every slot.
+	slotCap          int32      // max number of entry pointers a slot can hold.
+	slotsData        []entryPtr // shared by all 256 slots
+	maxEntryRatio    float64    // max size of an entry relative to the ring buffer.
+	admission        *tinyLFU   // nil unless the TinyLFU admission policy is enabled.
+	totalRejected    int64
+	lastVersion      uint32 // version of the latest write in the segment.
+	tags             *tagRegistry
+	onEvict          EvictCallback
+	evicted          []evictedEntry // reported by Cache.unlockSegment
+	compression      *compressor    // nil unless values are compressed.
+	compressedRaw    int64
+	compressedStored int64
+	cipher           *valueCipher
+	refresh          *refresher
+	staleHits        int64
+	stale            []refreshJob // queued by Cache.unlockSegment
+	events           *eventHub
+	pending          []Event // published by Cache.unlockSegment
+	hot              *hotKeys
+	hotTick          uint32
+	sampled          []hotSample // recorded by Cache.unlockSegment
+	maxPinnedRatio   float64     // max size of the pinned entries relative to the ring buffer.
+	pinnedCount      int64
+	pinnedBytes      int64
+}
+
+func newSegment(buf []byte, segId int, opts *Options) (seg segment) {
+	bufSize := len(buf)
+	seg.rb = newRingBufWithData(buf, 0)
 	seg.segId = segId
-	seg.timer = timer
+	seg.timer = opts.Timer
+	seg.maxEntryRatio = opts.MaxEntryRatio
+	seg.maxPinnedRatio = opts.MaxPinnedRatio
+	if opts.Admission == AdmissionTinyLFU {
+		seg.admission = newTinyLFU(bufSize)
+	}
 	seg.vacuumLen = int64(bufSize)
 	seg.slotCap = 1
 	seg.slotsData = make([]entryPtr, 256*seg.slotCap)
 	return
 }
 
-func (seg *segment) set(key, value []byte, hashVal uint64, expireSeconds int) (err error) {
-	if len(key) > 65535 {
-		return ErrLargeEntry
+// expireAtFor returns the expiration time in milliseconds of an entry written at nowMs.
+func expireAtFor(nowMs int64, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
 	}
-	maxKeyValLen := len(seg.rb.data)/4 - ENTRY_HDR_SIZE
+	ms := int64(ttl / time.Millisecond)
+	if ms == 0 {
+		ms = 1
+	}
+	return nowMs + ms
+}
+
+// inheritConfig copies the configuration of another segment, used when seg replaces it.
+func (seg *segment) inheritConfig(from *segment) {
+	seg.segId = from.segId
+	seg.timer = from.timer
+	seg.maxEntryRatio = from.maxEntryRatio
+	seg.maxPinnedRatio = from.maxPinnedRatio
+	seg.admission = from.admission
+	seg.tags = from.tags
+	seg.onEvict = from.onEvict
+	seg.compression = from.compression
+	seg.cipher = from.cipher
+	seg.refresh = from.refresh
+	seg.events = from.events
+	seg.hot = from.hot
+}
+
+func (seg *segment) set(key []byte, v storedValue, hashVal uint64, ttl time.Duration) (err error) {
+	return seg.setEntry(key, v, nil, hashVal, 0, ttl, false)
+}
 
-	if len(key)+len(value) > maxKeyValLen {
+// setEntry writes the entry, tags are the encoded tag data stored after the value.
+// The value is compressed before the size check, so compression raises the largest value.
+// A softTTL > 0 makes the entry stale after softTTL, see SetWithSoftTTL.
+// A pinned entry is kept by evacuate, see SetPinned.
+func (seg *segment) setEntry(key []byte, v storedValue, tags []byte, hashVal uint64, softTTL, ttl time.Duration, pinned bool) (err error) {
+	if len(key) > 65535 || len(tags) > 65535-maxMetaLen {
 		return ErrLargeEntry
 	}
-	now := seg.timer.Now()
-	expireAt := uint32(0)
-	if expireSeconds > 0 {
-		expireAt = now + uint32(expireSeconds)
+	value, codec, rawLen := v.data, v.codec, v.rawLen
+	maxKeyValLen := seg.maxKeyValLen()
+	nowMs := nowMilli(seg.timer)
+	now := uint32(nowMs / 1000)
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	hdr.expireAt = expireAtFor(nowMs, ttl)
+	var metaBuf [maxMetaLen]byte
+	meta := encodeMeta(hdr, codec, entryMeta{rawLen: uint32(rawLen), keyId: v.keyId, staleAt: expireAtFor(nowMs, softTTL)}, &metaBuf)
+	extLen := len(meta) + len(tags)
+	if len(key)+len(value)+extLen > maxKeyValLen {
+		return ErrLargeEntry
 	}
 	slotId := uint8(hashVal >> 8)
 	hash16 := uint16(hashVal >> 16)
+	if seg.admission != nil {
+		seg.admission.record(lfuKey(slotId, hash16))
+	}
+	if codec != CompressionNone {
+		atomic.AddInt64(&seg.compressedRaw, int64(rawLen))
+		atomic.AddInt64(&seg.compressedStored, int64(len(value)))
+	}
 	slot := seg.getSlot(slotId)
 	idx, match := seg.lookup(slot, hash16, key)
-	var hdrBuf [ENTRY_HDR_SIZE]byte
-	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
 	if match {
 		matchedPtr := &slot[idx]
-		seg.rb.ReadAt(hdrBuf[:], matchedPtr.offset)
-		hdr.slotId = slotId
-		hdr.hash16 = hash16
-		hdr.keyLen = uint16(len(key))
-		originAccessTime := hdr.accessTime
-		hdr.accessTime = now
-		hdr.expireAt = expireAt
-		hdr.valLen = uint32(len(value))
-		if hdr.valCap >= hdr.valLen {
-			atomic.AddInt64(&seg.totalTime, int64(hdr.accessTime)-int64(originAccessTime))
+		var oldBuf [ENTRY_HDR_SIZE]byte
+		old := (*entryHdr)(unsafe.Pointer(&oldBuf[0]))
+		seg.rb.ReadAt(oldBuf[:], matchedPtr.offset)
+		if pinned && !seg.pinnable(ENTRY_HDR_SIZE+int64(len(key))+int64(len(value)+extLen), old) {
+			return ErrPinnedLimit
+		}
+		seg.recordEvict(old, matchedPtr.offset, EvictReasonOverwritten)
+		hdr.valCap = old.valCap
+		if old.valCap >= uint32(len(value)+extLen) {
+			seg.addPinned(old, -1)
+			hdr.slotId = slotId
+			hdr.hash16 = hash16
+			hdr.keyLen = uint16(len(key))
+			hdr.accessTime = now
+			hdr.version = seg.nextVersion()
+			hdr.valLen = uint32(len(value))
+			hdr.extLen = uint16(extLen)
+			hdr.setFlag(flagPinned, pinned)
+			seg.addPinned(hdr, 1)
+			atomic.AddInt64(&seg.totalTime, int64(now)-int64(old.accessTime))
+			valOff := matchedPtr.offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
 			seg.rb.WriteAt(hdrBuf[:], matchedPtr.offset)
-			seg.rb.WriteAt(value, matchedPtr.offset+ENTRY_HDR_SIZE+int64(hdr.keyLen))
+			seg.rb.WriteAt(value, valOff)
+			seg.rb.WriteAt(meta, valOff+int64(hdr.valLen))
+			seg.rb.WriteAt(tags, valOff+int64(hdr.valLen)+int64(len(meta)))
 			atomic.AddInt64(&seg.overwrites, 1)
+			seg.notify(EventSet, key, 0)
+			seg.recordHot(key, rawLen)
 			return
 		}
 		seg.delEntryPtr(slotId, slot, idx)
 		match = false
-		for hdr.valCap < hdr.valLen {
+		if pinned {
+			// Pinned entries get their exact size, which pinnable checked.
+			hdr.valCap = uint32(len(value) + extLen)
+		}
+		for hdr.valCap < uint32(len(value)+extLen) {
 			hdr.valCap *= 2
 		}
 		if hdr.valCap > uint32(maxKeyValLen-len(key)) {
 			hdr.valCap = uint32(maxKeyValLen - len(key))
 		}
 	} else {
-		hdr.slotId = slotId
-		hdr.hash16 = hash16
-		hdr.keyLen = uint16(len(key))
-		hdr.accessTime = now
-		hdr.expireAt = expireAt
-		hdr.valLen = uint32(len(value))
-		hdr.valCap = uint32(len(value))
+		hdr.valCap = uint32(len(value) + extLen)
 		if hdr.valCap == 0 {
 			hdr.valCap = 1
 		}
+		if pinned && !seg.pinnable(ENTRY_HDR_SIZE+int64(len(key))+int64(hdr.valCap), nil) {
+			return ErrPinnedLimit
+		}
+		if !seg.admit(slotId, hash16, ENTRY_HDR_SIZE+int64(len(key))+int64(hdr.valCap), nowMs) {
+			return ErrNotAdmitted
+		}
 	}
+	hdr.slotId = slotId
+	hdr.hash16 = hash16
+	hdr.keyLen = uint16(len(key))
+	hdr.accessTime = now
+	hdr.version = seg.nextVersion()
+	hdr.valLen = uint32(len(value))
+	hdr.extLen = uint16(extLen)
+	hdr.setFlag(flagPinned, pinned)
 	entryLen := ENTRY_HDR_SIZE + int64(len(key)) + int64(hdr.valCap)
-	slotModified := seg.evacuate(entryLen, slotId, now)
+	slotModified := seg.evacuate(entryLen, slotId, nowMs)
 	if slotModified {
 		slot = seg.getSlot(slotId)
 		idx, match = seg.lookup(slot, hash16, key)
@@ -130,13 +237,56 @@ func (seg *segment) set(key, value []byte, hashVal uint64, expireSeconds int) (e
 	seg.rb.Write(hdrBuf[:])
 	seg.rb.Write(key)
 	seg.rb.Write(value)
-	seg.rb.Skip(int64(hdr.valCap - hdr.valLen))
+	seg.rb.Write(meta)
+	seg.rb.Write(tags)
+	seg.rb.Skip(int64(hdr.valCap - hdr.valLen - uint32(hdr.extLen)))
 	atomic.AddInt64(&seg.totalTime, int64(now))
+	atomic.AddInt64(&seg.totalCount, 1)
+	seg.addPinned(hdr, 1)
 	seg.vacuumLen -= entryLen
+	seg.notify(EventSet, key, 0)
+	seg.recordHot(key, rawLen)
 	return
 }
 
-func (seg *segment) touch(key []byte, hashVal uint64, expireSeconds int) (err error) {
+// maxKeyValLen returns the largest stored size of the key, value and tags of an entry.
+func (seg *segment) maxKeyValLen() int {
+	return int(float64(len(seg.rb.data))*seg.maxEntryRatio) - ENTRY_HDR_SIZE
+}
+
+// nextVersion returns the version for a new write.
+// Versions grow for the whole segment, so a deleted and re-created key never reuses one.
+func (seg *segment) nextVersion() uint32 {
+	seg.lastVersion++
+	if seg.lastVersion == 0 {
+		seg.lastVersion = 1
+	}
+	return seg.lastVersion
+}
+
+// version returns the version of a live entry without counting it as an access.
+func (seg *segment) version(key []byte, hashVal uint64) (version uint32, found bool) {
+	hdr, _, err := seg.locate(key, hashVal, true)
+	if err != nil || hdr.expireAt != 0 && hdr.expireAt <= nowMilli(seg.timer) {
+		return 0, false
+	}
+	return hdr.version, true
+}
+
+// getWithVersion returns a copy of the value and its version.
+func (seg *segment) getWithVersion(key []byte, hashVal uint64) (value []byte, version uint32, err error) {
+	hdr, ptr, err := seg.locate(key, hashVal, false)
+	if err != nil {
+		return
+	}
+	if value, err = seg.readValue(hdr, ptr.offset, nil); err != nil {
+		return nil, 0, seg.readFailed(hdr, ptr.offset, err, false)
+	}
+	atomic.AddInt64(&seg.hitCount, 1)
+	return value, hdr.version, nil
+}
+
+func (seg *segment) touch(key []byte, hashVal uint64, ttl time.Duration) (err error) {
 	if len(key) > 65535 {
 		return ErrLargeKey
 	}
@@ -152,21 +302,26 @@ func (seg *segment) touch(key []byte, hashVal uint64, expireSeconds int) (err er
 	var hdrBuf [ENTRY_HDR_SIZE]byte
 	seg.rb.ReadAt(hdrBuf[:], matchedPtr.offset)
 	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
-	now := seg.timer.Now()
-	if hdr.expireAt != 0 && hdr.expireAt <= now {
+	nowMs := nowMilli(seg.timer)
+	now := uint32(nowMs / 1000)
+	if hdr.expireAt != 0 && hdr.expireAt <= nowMs {
+		seg.recordEvict(hdr, matchedPtr.offset, EvictReasonExpired)
 		seg.delEntryPtr(slotId, slot, idx)
 		atomic.AddInt64(&seg.totalExpired, 1)
 		err = ErrNotFound
 		atomic.AddInt64(&seg.missCount, 1)
 		return
 	}
-	expireAt := uint32(0)
-	if expireSeconds > 0 {
-		expireAt = now + uint32(expireSeconds)
+	if seg.invalidated(hdr, matchedPtr.offset) {
+		seg.recordEvict(hdr, matchedPtr.offset, EvictReasonInvalidated)
+		seg.delEntryPtr(slotId, slot, idx)
+		err = ErrNotFound
+		atomic.AddInt64(&seg.missCount, 1)
+		return
 	}
 	originAccessTime := hdr.accessTime
 	hdr.accessTime = now
-	hdr.expireAt = expireAt
+	hdr.expireAt = expireAtFor(nowMs, ttl)
 	//in place overwrite
 	atomic.AddInt64(&seg.totalTime, int64(hdr.accessTime)-int64(originAccessTime))
 	seg.rb.WriteAt(hdrBuf[:], matchedPtr.offset)
@@ -218,8 +373,9 @@ func (seg *segment) delEntryPtr(slotId uint8, slot []entryPtr, idx int) {
 	var entryHdrBuf [ENTRY_HDR_SIZE]byte
 	seg.rb.ReadAt(entryHdrBuf[:], offset)
 	entryHdr := (*entryHdr)(unsafe.Pointer(&entryHdrBuf[0]))
-	entryHdr.deleted = true
+	entryHdr.setFlag(flagDeleted, true)
 	seg.rb.WriteAt(entryHdrBuf[:], offset)
+	seg.addPinned(entryHdr, -1)
 	copy(slot[idx:], slot[idx+1:])
 	seg.slotLens[slotId]--
 	atomic.AddInt64(&seg.entryCount, -1)
@@ -234,24 +390,37 @@ func (seg *segment) delEntryPtrByOffset(slotId uint8, hash16 uint16, offset int6
 	seg.delEntryPtr(slotId, slot, idx)
 }
 
-func (seg *segment) evacuate(entryLen int64, slotId uint8, now uint32) (slotModified bool) {
+func (seg *segment) evacuate(entryLen int64, slotId uint8, nowMs int64) (slotModified bool) {
 	var oldHdrBuf [ENTRY_HDR_SIZE]byte
 	consecutiveEvacuate := 0
+	// pinnedMoved stops evacuate from moving pinned entries forever if nothing else is left.
+	var pinnedMoved int64
 	for seg.vacuumLen < entryLen {
 		oldOff := seg.rb.End() + seg.vacuumLen - seg.rb.Size()
 		seg.rb.ReadAt(oldHdrBuf[:], oldOff)
 		oldHdr := (*entryHdr)(unsafe.Pointer(&oldHdrBuf[0]))
 		oldEntryLen := ENTRY_HDR_SIZE + int64(oldHdr.keyLen) + int64(oldHdr.valCap)
-		if oldHdr.deleted {
+		if oldHdr.has(flagDeleted) {
 			consecutiveEvacuate = 0
 			atomic.AddInt64(&seg.totalTime, -int64(oldHdr.accessTime))
 			atomic.AddInt64(&seg.totalCount, -1)
 			seg.vacuumLen += oldEntryLen
 			continue
 		}
-		expired := oldHdr.expireAt != 0 && oldHdr.expireAt < now
+		expired := oldHdr.expireAt != 0 && oldHdr.expireAt < nowMs
+		if oldHdr.has(flagPinned) && !expired && pinnedMoved < seg.rb.Size() {
+			newOff := seg.rb.Evacuate(oldOff, int(oldEntryLen))
+			seg.updateEntryPtr(oldHdr.slotId, oldHdr.hash16, oldOff, newOff)
+			pinnedMoved += oldEntryLen
+			continue
+		}
 		leastRecentUsed := int64(oldHdr.accessTime)*atomic.LoadInt64(&seg.totalCount) <= atomic.LoadInt64(&seg.totalTime)
 		if expired || leastRecentUsed || consecutiveEvacuate > 5 {
+			if expired {
+				seg.recordEvict(oldHdr, oldOff, EvictReasonExpired)
+			} else {
+				seg.recordEvict(oldHdr, oldOff, EvictReasonCapacity)
+			}
 			seg.delEntryPtrByOffset(oldHdr.slotId, oldHdr.hash16, oldOff)
 			if oldHdr.slotId == slotId {
 				slotModified = true
@@ -275,19 +444,47 @@ func (seg *segment) evacuate(entryLen int64, slotId uint8, now uint32) (slotModi
 	return
 }
 
-func (seg *segment) get(key, buf []byte, hashVal uint64, peek bool) (value []byte, expireAt uint32, err error) {
+// resize changes the size of the ring buffer, dropping the oldest entries that do not fit.
+func (seg *segment) resize(newSize int) {
+	if newSize == len(seg.rb.data) {
+		return
+	}
+	nowMs := nowMilli(seg.timer)
+	used := seg.rb.Size() - seg.vacuumLen
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	for used > int64(newSize) {
+		off := seg.rb.End() - used
+		seg.rb.ReadAt(hdrBuf[:], off)
+		entryLen := ENTRY_HDR_SIZE + int64(hdr.keyLen) + int64(hdr.valCap)
+		if !hdr.has(flagDeleted) {
+			expired := hdr.expireAt != 0 && hdr.expireAt < nowMs
+			if expired {
+				seg.recordEvict(hdr, off, EvictReasonExpired)
+				atomic.AddInt64(&seg.totalExpired, 1)
+			} else {
+				seg.recordEvict(hdr, off, EvictReasonCapacity)
+				atomic.AddInt64(&seg.totalEvacuate, 1)
+			}
+			seg.delEntryPtrByOffset(hdr.slotId, hdr.hash16, off)
+		}
+		atomic.AddInt64(&seg.totalTime, -int64(hdr.accessTime))
+		atomic.AddInt64(&seg.totalCount, -1)
+		used -= entryLen
+	}
+	seg.rb.Resize(newSize)
+	seg.vacuumLen = int64(newSize) - used
+}
+
+func (seg *segment) get(key, buf []byte, hashVal uint64, peek bool) (value []byte, expireAt int64, err error) {
 	hdr, ptr, err := seg.locate(key, hashVal, peek)
 	if err != nil {
 		return
 	}
 	expireAt = hdr.expireAt
-	if cap(buf) >= int(hdr.valLen) {
-		value = buf[:hdr.valLen]
-	} else {
-		value = make([]byte, hdr.valLen)
+	if value, err = seg.readValue(hdr, ptr.offset, buf); err != nil {
+		return nil, 0, seg.readFailed(hdr, ptr.offset, err, peek)
 	}
-
-	seg.rb.ReadAt(value, ptr.offset+ENTRY_HDR_SIZE+int64(hdr.keyLen))
 	if !peek {
 		atomic.AddInt64(&seg.hitCount, 1)
 	}
@@ -299,10 +496,15 @@ func (seg *segment) view(key []byte, fn func([]byte) error, hashVal uint64, peek
 	if err != nil {
 		return err
 	}
-	start := ptr.offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
-	val, err := seg.rb.Slice(start, int64(hdr.valLen))
+	var val []byte
+	if hdr.plain() {
+		start := ptr.offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
+		val, err = seg.rb.Slice(start, int64(hdr.valLen))
+	} else {
+		val, err = seg.readValue(hdr, ptr.offset, nil)
+	}
 	if err != nil {
-		return err
+		return seg.readFailed(hdr, ptr.offset, err, peek)
 	}
 	err = fn(val)
 	if !peek {
@@ -315,6 +517,9 @@ func (seg *segment) view(key []byte, fn func([]byte) error, hashVal uint64, peek
 func (seg *segment) locate(key []byte, hashVal uint64, peek bool) (hdr *entryHdr, ptr *entryPtr, err error) {
 	slotId := uint8(hashVal >> 8)
 	hash16 := uint16(hashVal >> 16)
+	if seg.admission != nil && !peek {
+		seg.admission.record(lfuKey(slotId, hash16))
+	}
 	slot := seg.getSlot(slotId)
 	idx, match := seg.lookup(slot, hash16, key)
 	if !match {
@@ -328,18 +533,32 @@ func (seg *segment) locate(key []byte, hashVal uint64, peek bool) (hdr *entryHdr
 	var hdrBuf [ENTRY_HDR_SIZE]byte
 	seg.rb.ReadAt(hdrBuf[:], ptr.offset)
 	hdr = (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	if seg.invalidated(hdr, ptr.offset) {
+		if !peek {
+			seg.recordEvict(hdr, ptr.offset, EvictReasonInvalidated)
+			seg.delEntryPtr(slotId, slot, idx)
+			atomic.AddInt64(&seg.missCount, 1)
+		}
+		return nil, nil, ErrNotFound
+	}
 	if !peek {
-		now := seg.timer.Now()
-		if hdr.expireAt != 0 && hdr.expireAt <= now {
+		nowMs := nowMilli(seg.timer)
+		now := uint32(nowMs / 1000)
+		if hdr.expireAt != 0 && hdr.expireAt <= nowMs {
+			seg.recordEvict(hdr, ptr.offset, EvictReasonExpired)
 			seg.delEntryPtr(slotId, slot, idx)
 			atomic.AddInt64(&seg.totalExpired, 1)
 			err = ErrNotFound
 			atomic.AddInt64(&seg.missCount, 1)
 			return
 		}
+		if staleAt := seg.staleAt(hdr, ptr.offset); staleAt != 0 && staleAt <= nowMs {
+			seg.recordStale(key, hashVal)
+		}
 		atomic.AddInt64(&seg.totalTime, int64(now-hdr.accessTime))
 		hdr.accessTime = now
 		seg.rb.WriteAt(hdrBuf[:], ptr.offset)
+		seg.recordHot(key, 0)
 	}
 	return hdr, ptr, err
 }
@@ -352,11 +571,37 @@ func (seg *segment) del(key []byte, hashVal uint64) (affected bool) {
 	if !match {
 		return false
 	}
-	seg.delEntryPtr(slotId, slot, idx)
+	seg.delEntry(slotId, slot, idx)
 	return true
 }
 
-func (seg *segment) ttl(key []byte, hashVal uint64) (timeLeft uint32, err error) {
+// delEntry deletes the entry at idx of the slot and reports it to the evict callback.
+func (seg *segment) delEntry(slotId uint8, slot []entryPtr, idx int) {
+	if seg.onEvict != nil || seg.events.enabled() {
+		var hdrBuf [ENTRY_HDR_SIZE]byte
+		seg.rb.ReadAt(hdrBuf[:], slot[idx].offset)
+		seg.recordEvict((*entryHdr)(unsafe.Pointer(&hdrBuf[0])), slot[idx].offset, EvictReasonDeleted)
+	}
+	seg.delEntryPtr(slotId, slot, idx)
+}
+
+// delPrefix deletes all entries whose key starts with prefix.
+func (seg *segment) delPrefix(prefix []byte) (deleted int) {
+	for i := 0; i < 256; i++ {
+		slotId := uint8(i)
+		slot := seg.getSlot(slotId)
+		for idx := len(slot) - 1; idx >= 0; idx-- {
+			ptr := &slot[idx]
+			if int(ptr.keyLen) >= len(prefix) && seg.rb.EqualAt(prefix, ptr.offset+ENTRY_HDR_SIZE) {
+				seg.delEntry(slotId, slot, idx)
+				deleted++
+			}
+		}
+	}
+	return
+}
+
+func (seg *segment) ttl(key []byte, hashVal uint64) (timeLeft time.Duration, err error) {
 	slotId := uint8(hashVal >> 8)
 	hash16 := uint16(hashVal >> 16)
 	slot := seg.getSlot(slotId)
@@ -366,16 +611,19 @@ func (seg *segment) ttl(key []byte, hashVal uint64) (timeLeft uint32, err error)
 		return
 	}
 	ptr := &slot[idx]
-	now := seg.timer.Now()
+	nowMs := nowMilli(seg.timer)
 	var hdrBuf [ENTRY_HDR_SIZE]byte
 	seg.rb.ReadAt(hdrBuf[:], ptr.offset)
 	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
-
+	if seg.invalidated(hdr, ptr.offset) {
+		err = ErrNotFound
+		return
+	}
 	if hdr.expireAt == 0 {
 		timeLeft = 0
 		return
-	} else if hdr.expireAt != 0 && hdr.expireAt >= now {
-		timeLeft = hdr.expireAt - now
+	} else if hdr.expireAt != 0 && hdr.expireAt >= nowMs {
+		timeLeft = time.Duration(hdr.expireAt-nowMs) * time.Millisecond
 		return
 	}
 	err = ErrNotFound
@@ -432,9 +680,14 @@ func (seg *segment) resetStatistics() {
 	atomic.StoreInt64(&seg.overwrites, 0)
 	atomic.StoreInt64(&seg.hitCount, 0)
 	atomic.StoreInt64(&seg.missCount, 0)
+	atomic.StoreInt64(&seg.totalRejected, 0)
+	atomic.StoreInt64(&seg.compressedRaw, 0)
+	atomic.StoreInt64(&seg.compressedStored, 0)
+	atomic.StoreInt64(&seg.staleHits, 0)
 }
 
 func (seg *segment) clear() {
+	seg.recordEvictAll(EvictReasonCleared)
 	bufSize := len(seg.rb.data)
 	seg.rb.Reset(0)
 	seg.vacuumLen = int64(bufSize)
@@ -451,6 +704,12 @@ func (seg *segment) clear() {
 	atomic.StoreInt64(&seg.totalEvacuate, 0)
 	atomic.StoreInt64(&seg.totalExpired, 0)
 	atomic.StoreInt64(&seg.overwrites, 0)
+	atomic.StoreInt64(&seg.totalRejected, 0)
+	atomic.StoreInt64(&seg.compressedRaw, 0)
+	atomic.StoreInt64(&seg.compressedStored, 0)
+	atomic.StoreInt64(&seg.staleHits, 0)
+	atomic.StoreInt64(&seg.pinnedCount, 0)
+	atomic.StoreInt64(&seg.pinnedBytes, 0)
 }
 
 func (seg *segment) getSlot(slotId uint8) []entryPtr {
@@ -0,0 +1,284 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	snapshotMagic   = 0x50414e53 // "SNAP"
+	snapshotVersion = 8
+	// snapshotPtrSize is the encoded size of an entryPtr: offset, hash16 and keyLen.
+	snapshotPtrSize = 12
+)
+
+var ErrInvalidSnapshot = errors.New("Invalid cache snapshot")
+var ErrSnapshotVersion = errors.New("Unsupported cache snapshot version")
+var ErrSnapshotLayout = errors.New("Cache snapshot segment layout mismatch")
+
+// snapshotHeader is written once at the beginning of a snapshot.
+type snapshotHeader struct {
+	Magic        uint32
+	Version      uint32
+	SegmentCount uint32
+	EntryHdrSize uint32
+}
+
+// segmentHeader describes the ring buffer and statistics of one segment.
+type segmentHeader struct {
+	BufSize       int64
+	Begin         int64
+	End           int64
+	Index         int64
+	VacuumLen     int64
+	SlotCap       int32
+	LastVersion   uint32
+	MissCount     int64
+	HitCount      int64
+	EntryCount    int64
+	TotalCount    int64
+	TotalTime     int64
+	TotalEvacuate int64
+	TotalExpired  int64
+	Overwrites    int64
+	Touched       int64
+	PinnedCount   int64
+	PinnedBytes   int64
+	SlotLens      [256]int32
+}
+
+// SaveTo writes a snapshot of the cache to w.
+// Every segment is copied under its own lock, so the snapshot is consistent
+// per segment but not across segments. Entries invalidated by a tag or by a new
+// encryption key are removed from the cache first, a snapshot does not keep that state.
+func (cache *Cache) SaveTo(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+	hdr := snapshotHeader{
+		Magic:        snapshotMagic,
+		Version:      snapshotVersion,
+		SegmentCount: uint32(len(cache.segments)),
+		EntryHdrSize: ENTRY_HDR_SIZE,
+	}
+	if err = binary.Write(bw, binary.LittleEndian, &hdr); err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	for i := range cache.segments {
+		buf.Reset()
+		cache.locks[i].Lock()
+		cache.segments[i].dropInvalidated()
+		err = cache.segments[i].dump(&buf)
+		cache.unlockSegment(uint64(i))
+		if err != nil {
+			return
+		}
+		if _, err = bw.Write(buf.Bytes()); err != nil {
+			return
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadFrom replaces the contents of the cache with a snapshot read from r.
+// The snapshot must have been taken from a cache with the same segment layout,
+// entries that already expired are dropped.
+// If an error is returned the cache is left unchanged.
+func (cache *Cache) LoadFrom(r io.Reader) (err error) {
+	br := bufio.NewReader(r)
+	var hdr snapshotHeader
+	if err = binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return ErrInvalidSnapshot
+	}
+	if hdr.Magic != snapshotMagic {
+		return ErrInvalidSnapshot
+	}
+	if hdr.Version != snapshotVersion || hdr.EntryHdrSize != ENTRY_HDR_SIZE {
+		return ErrSnapshotVersion
+	}
+	if hdr.SegmentCount != uint32(len(cache.segments)) {
+		return ErrSnapshotLayout
+	}
+	segments := make([]segment, len(cache.segments))
+	for i := range segments {
+		cache.locks[i].Lock()
+		bufSize := len(cache.segments[i].rb.data)
+		segments[i].inheritConfig(&cache.segments[i])
+		cache.locks[i].Unlock()
+		if err = segments[i].load(br, bufSize); err != nil {
+			return
+		}
+	}
+	for i := range segments {
+		cache.locks[i].Lock()
+		segments[i].inheritConfig(&cache.segments[i])
+		if cache.mapped != nil {
+			// Keep the ring buffer in the mapped file.
+			segments[i].rb.data = append(cache.segments[i].rb.data[:0], segments[i].rb.data...)
+		}
+		cache.segments[i] = segments[i]
+		cache.locks[i].Unlock()
+	}
+	return
+}
+
+// SaveToFile writes a snapshot of the cache to the named file.
+// The snapshot is written to a temporary file first and renamed into place,
+// so an existing snapshot is never left half written.
+func (cache *Cache) SaveToFile(path string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err = cache.SaveTo(f); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFromFile loads a snapshot written by SaveToFile.
+func (cache *Cache) LoadFromFile(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return cache.LoadFrom(f)
+}
+
+// header returns the ring buffer position and the statistics of the segment.
+func (seg *segment) header() segmentHeader {
+	return segmentHeader{
+		BufSize:       int64(len(seg.rb.data)),
+		Begin:         seg.rb.begin,
+		End:           seg.rb.end,
+		Index:         int64(seg.rb.index),
+		VacuumLen:     seg.vacuumLen,
+		SlotCap:       seg.slotCap,
+		LastVersion:   seg.lastVersion,
+		MissCount:     atomic.LoadInt64(&seg.missCount),
+		HitCount:      atomic.LoadInt64(&seg.hitCount),
+		EntryCount:    atomic.LoadInt64(&seg.entryCount),
+		TotalCount:    atomic.LoadInt64(&seg.totalCount),
+		TotalTime:     atomic.LoadInt64(&seg.totalTime),
+		TotalEvacuate: atomic.LoadInt64(&seg.totalEvacuate),
+		TotalExpired:  atomic.LoadInt64(&seg.totalExpired),
+		Overwrites:    atomic.LoadInt64(&seg.overwrites),
+		Touched:       atomic.LoadInt64(&seg.touched),
+		PinnedCount:   atomic.LoadInt64(&seg.pinnedCount),
+		PinnedBytes:   atomic.LoadInt64(&seg.pinnedBytes),
+		SlotLens:      seg.slotLens,
+	}
+}
+
+func (seg *segment) dump(w io.Writer) (err error) {
+	hdr := seg.header()
+	if err = binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		return
+	}
+	var ptrBuf [snapshotPtrSize]byte
+	for i := 0; i < 256; i++ {
+		for _, ptr := range seg.getSlot(uint8(i)) {
+			binary.LittleEndian.PutUint64(ptrBuf[0:], uint64(ptr.offset))
+			binary.LittleEndian.PutUint16(ptrBuf[8:], ptr.hash16)
+			binary.LittleEndian.PutUint16(ptrBuf[10:], ptr.keyLen)
+			if _, err = w.Write(ptrBuf[:]); err != nil {
+				return
+			}
+		}
+	}
+	_, err = w.Write(seg.rb.data)
+	return
+}
+
+func (seg *segment) load(r io.Reader, bufSize int) (err error) {
+	var hdr segmentHeader
+	if err = binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return ErrInvalidSnapshot
+	}
+	if hdr.BufSize != int64(bufSize) {
+		return ErrSnapshotLayout
+	}
+	if hdr.SlotCap <= 0 || hdr.End < hdr.Begin || hdr.End-hdr.Begin > hdr.BufSize ||
+		hdr.Index < 0 || hdr.Index >= hdr.BufSize {
+		return ErrInvalidSnapshot
+	}
+	seg.slotCap = hdr.SlotCap
+	seg.slotLens = hdr.SlotLens
+	seg.slotsData = make([]entryPtr, 256*int(seg.slotCap))
+	var ptrBuf [snapshotPtrSize]byte
+	for i := 0; i < 256; i++ {
+		if seg.slotLens[i] < 0 || seg.slotLens[i] > seg.slotCap {
+			return ErrInvalidSnapshot
+		}
+		slotOff := int32(i) * seg.slotCap
+		slot := seg.slotsData[slotOff : slotOff+seg.slotLens[i]]
+		for j := range slot {
+			if _, err = io.ReadFull(r, ptrBuf[:]); err != nil {
+				return ErrInvalidSnapshot
+			}
+			slot[j].offset = int64(binary.LittleEndian.Uint64(ptrBuf[0:]))
+			slot[j].hash16 = binary.LittleEndian.Uint16(ptrBuf[8:])
+			slot[j].keyLen = binary.LittleEndian.Uint16(ptrBuf[10:])
+		}
+	}
+	seg.rb.data = make([]byte, bufSize)
+	if _, err = io.ReadFull(r, seg.rb.data); err != nil {
+		return ErrInvalidSnapshot
+	}
+	seg.rb.begin = hdr.Begin
+	seg.rb.end = hdr.End
+	seg.rb.index = int(hdr.Index)
+	seg.vacuumLen = hdr.VacuumLen
+	seg.lastVersion = hdr.LastVersion
+	seg.missCount = hdr.MissCount
+	seg.hitCount = hdr.HitCount
+	seg.entryCount = hdr.EntryCount
+	seg.totalCount = hdr.TotalCount
+	seg.totalTime = hdr.TotalTime
+	seg.totalEvacuate = hdr.TotalEvacuate
+	seg.totalExpired = hdr.TotalExpired
+	seg.overwrites = hdr.Overwrites
+	seg.touched = hdr.Touched
+	seg.pinnedCount = hdr.PinnedCount
+	seg.pinnedBytes = hdr.PinnedBytes
+	seg.dropExpired()
+	return
+}
+
+// dropExpired removes the entries that expired while the snapshot was on disk.
+func (seg *segment) dropExpired() {
+	nowMs := nowMilli(seg.timer)
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	for i := 0; i < 256; i++ {
+		slotId := uint8(i)
+		slot := seg.getSlot(slotId)
+		for idx := len(slot) - 1; idx >= 0; idx-- {
+			seg.rb.ReadAt(hdrBuf[:], slot[idx].offset)
+			if hdr.expireAt != 0 && hdr.expireAt <= nowMs {
+				seg.delEntryPtr(slotId, slot, idx)
+				atomic.AddInt64(&seg.totalExpired, 1)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// tagRegistry remembers when tags were invalidated.
+// Tagged entries store the stamp of their write and the hashes of their tags,
+// an entry is stale if any of its tags was invalidated after the write.
+// Invalidation is checked lazily when an entry is read, so InvalidateTag does not
+// scan the segments. Every invalidated tag keeps a 16 byte record, at most maxInvalidatedTags
+// of them. Above that the older half is dropped and floor is raised to the newest dropped
+// stamp, which invalidates every tagged entry written before it.
+// The registry is not persisted, SaveTo and closing a memory mapped cache drop the
+// invalidated entries instead.
+type tagRegistry struct {
+	clock       int64 // increases on every tagged write and invalidation.
+	mu          sync.RWMutex
+	invalidated map[uint64]int64
+	floor       int64 // tagged entries written at or before floor are invalidated.
+}
+
+const maxInvalidatedTags = 1 << 16
+
+func (r *tagRegistry) init() {
+	// Starting at the wall clock keeps stamps of entries restored from a snapshot
+	// older than invalidations made after the restart.
+	r.clock = time.Now().UnixNano()
+	r.invalidated = make(map[uint64]int64)
+}
+
+func (r *tagRegistry) stamp() int64 {
+	return atomic.AddInt64(&r.clock, 1)
+}
+
+// invalidatedAfter reports whether the tag was invalidated after the write with the stamp.
+func (r *tagRegistry) invalidatedAfter(tagHash uint64, stamp int64) bool {
+	r.mu.RLock()
+	invalidated := stamp <= r.floor || r.invalidated[tagHash] > stamp
+	r.mu.RUnlock()
+	return invalidated
+}
+
+// prune drops the older half of the records, r.mu must be held.
+func (r *tagRegistry) prune() {
+	stamps := make([]int64, 0, len(r.invalidated))
+	for _, stamp := range r.invalidated {
+		stamps = append(stamps, stamp)
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i] < stamps[j] })
+	r.floor = stamps[len(stamps)/2]
+	for tagHash, stamp := range r.invalidated {
+		if stamp <= r.floor {
+			delete(r.invalidated, tagHash)
+		}
+	}
+}
+
+// SetWithTags sets the value and associates it with tags, InvalidateTag removes it
+// together with all other entries sharing one of the tags.
+// Overwriting the key without tags, e.g. with Set, drops the association.
+func (cache *Cache) SetWithTags(key, value []byte, ttl time.Duration, tags ...string) (err error) {
+	var tagData []byte
+	if len(tags) > 0 {
+		tagData = make([]byte, 8+8*len(tags))
+		binary.LittleEndian.PutUint64(tagData, uint64(cache.tags.stamp()))
+		for i, tag := range tags {
+			binary.LittleEndian.PutUint64(tagData[8+8*i:], cache.hasher.Sum64([]byte(tag)))
+		}
+	}
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	v := cache.encodeValue(key, value)
+	cache.locks[segID].Lock()
+	err = cache.segments[segID].setEntry(key, v, tagData, hashVal, 0, ttl, false)
+	cache.unlockSegment(segID)
+	return
+}
+
+// InvalidateTag invalidates all entries that were set with the tag before the call.
+// The entries are removed lazily, reads stop returning them immediately.
+func (cache *Cache) InvalidateTag(tag string) {
+	tagHash := cache.hasher.Sum64([]byte(tag))
+	r := &cache.tags
+	r.mu.Lock()
+	r.invalidated[tagHash] = r.stamp()
+	if len(r.invalidated) > maxInvalidatedTags {
+		r.prune()
+	}
+	r.mu.Unlock()
+}
+
+// invalidated reports whether the entry at offset was encrypted with another key than
+// the current one, or whether one of its tags was invalidated after it was written.
+func (seg *segment) invalidated(hdr *entryHdr, offset int64) bool {
+	if seg.cipher != nil && seg.keyID(hdr, offset) != seg.cipher.keyID() {
+		return true
+	}
+	tagLen := hdr.tagLen()
+	if tagLen <= 0 || seg.tags == nil {
+		return false
+	}
+	var buf [8]byte
+	off := offset + ENTRY_HDR_SIZE + int64(hdr.keyLen) + int64(hdr.valLen) + int64(hdr.metaLen())
+	seg.rb.ReadAt(buf[:], off)
+	stamp := int64(binary.LittleEndian.Uint64(buf[:]))
+	for end := off + int64(tagLen); off+8 < end; {
+		off += 8
+		seg.rb.ReadAt(buf[:], off)
+		if seg.tags.invalidatedAfter(binary.LittleEndian.Uint64(buf[:]), stamp) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropInvalidated removes the invalidated entries, used before the segment is persisted
+// because the tag registry and the encryption key are not.
+func (seg *segment) dropInvalidated() {
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	for i := 0; i < 256; i++ {
+		slotId := uint8(i)
+		slot := seg.getSlot(slotId)
+		for idx := len(slot) - 1; idx >= 0; idx-- {
+			seg.rb.ReadAt(hdrBuf[:], slot[idx].offset)
+			if seg.invalidated(hdr, slot[idx].offset) {
+				seg.recordEvict(hdr, slot[idx].offset, EvictReasonInvalidated)
+				seg.delEntryPtr(slotId, slot, idx)
+			}
+		}
+	}
+}
@@ -5,10 +5,19 @@ import (
 	"time"
 )
 
+// Timer returns the current Unix time in seconds.
 type Timer interface {
 	Now() uint32
 }
 
+// MilliTimer is a Timer that also reports the time in milliseconds.
+// Expiration times are kept in milliseconds, a Timer that does not implement
+// MilliTimer still works but expires entries with second precision only.
+type MilliTimer interface {
+	Timer
+	NowMilli() int64
+}
+
 type StoppableTimer interface {
 	Timer
 	Stop()
@@ -18,6 +27,18 @@ func getUnixTime() uint32 {
 	return uint32(time.Now().Unix())
 }
 
+func getUnixMilli() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// nowMilli returns the time of the timer in milliseconds.
+func nowMilli(timer Timer) int64 {
+	if milliTimer, ok := timer.(MilliTimer); ok {
+		return milliTimer.NowMilli()
+	}
+	return int64(timer.Now()) * 1000
+}
+
 type defaultTimer struct {
 }
 
@@ -25,16 +46,27 @@ func (timer defaultTimer) Now() uint32 {
 	return getUnixTime()
 }
 
+func (timer defaultTimer) NowMilli() int64 {
+	return getUnixMilli()
+}
+
 type cachedTimer struct {
-	now    uint32
+	now    int64
 	ticker *time.Ticker
 	done   chan bool
 }
 
+// NewCachedTimer returns a timer that reads the clock once per second.
 func NewCachedTimer() StoppableTimer {
+	return NewCachedTimerWithInterval(time.Second)
+}
+
+// NewCachedTimerWithInterval returns a timer that reads the clock once per interval.
+// The returned timer implements MilliTimer, its precision is the interval.
+func NewCachedTimerWithInterval(interval time.Duration) StoppableTimer {
 	timer := &cachedTimer{
-		now:    getUnixTime(),
-		ticker: time.NewTicker(time.Second),
+		now:    getUnixMilli(),
+		ticker: time.NewTicker(interval),
 		done:   make(chan bool, 1),
 	}
 	go timer.update()
@@ -42,7 +74,11 @@ func NewCachedTimer() StoppableTimer {
 }
 
 func (timer *cachedTimer) Now() uint32 {
-	return atomic.LoadUint32(&timer.now)
+	return uint32(atomic.LoadInt64(&timer.now) / 1000)
+}
+
+func (timer *cachedTimer) NowMilli() int64 {
+	return atomic.LoadInt64(&timer.now)
 }
 
 func (timer *cachedTimer) Stop() {
@@ -59,7 +95,7 @@ func (timer *cachedTimer) update() {
 		case <-timer.done:
 			return
 		case <-timer.ticker.C:
-			atomic.StoreUint32(&timer.now, getUnixTime())
+			atomic.StoreInt64(&timer.now, getUnixMilli())
 		}
 	}
 }
@@ -0,0 +1,35 @@
+package cache
+
+import "time"
+
+// GetWithVersion returns the value and its version.
+// The version changes on every write of the key and can be passed to CompareAndSet.
+func (cache *Cache) GetWithVersion(key []byte) (value []byte, version uint32, err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	cache.locks[segID].Lock()
+	value, version, err = cache.segments[segID].getWithVersion(key, hashVal)
+	cache.unlockSegment(segID)
+	return
+}
+
+// CompareAndSet sets the value only if the version of the entry is still expectedVersion.
+// An expectedVersion of 0 means the key must not exist.
+// It returns the new version, or ErrVersionMismatch if the entry was changed, deleted or created
+// since expectedVersion was read.
+func (cache *Cache) CompareAndSet(key, value []byte, expectedVersion uint32, ttl time.Duration) (version uint32, err error) {
+	hashVal := cache.hasher.Sum64(key)
+	segID := cache.segmentID(hashVal)
+	v := cache.encodeValue(key, value)
+	cache.locks[segID].Lock()
+	defer cache.unlockSegment(segID)
+	seg := &cache.segments[segID]
+	if version, _ = seg.version(key, hashVal); version != expectedVersion {
+		return 0, ErrVersionMismatch
+	}
+	if err = seg.set(key, v, hashVal, ttl); err != nil {
+		return 0, err
+	}
+	version, _ = seg.version(key, hashVal)
+	return
+}